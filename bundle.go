@@ -0,0 +1,123 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// bundleReportFile is the name of the file of a -bundle archive describing
+// the run of go-bb that wrote it.
+const bundleReportFile = "go-bb-report.txt"
+
+// bundleSource is the directory of the prepared module once it exists, and
+// bundleOverlay the files replacing some of its own, for die to bundle.
+var (
+	bundleSource  string
+	bundleOverlay map[string]string
+)
+
+// writeBundle writes a zip archive of the directory dir to outPath, with a
+// bundleReportFile holding the command line of go-bb, the version of the go
+// command and errMsg, the error go-bb exits with, if any. extra are other
+// files to add, by name in the archive, in place of the files of dir of the
+// same name. All are under a top-level directory named like outPath, without
+// extension.
+func writeBundle(outPath, dir, errMsg string, extra map[string]string) error {
+	f, err := os.Create(outPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	root := strings.TrimSuffix(filepath.Base(outPath), filepath.Ext(outPath))
+
+	report := fmt.Sprintf("%s\ngo-bb built with %s %s/%s\n", shellQuoteArgs(os.Args), runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	if v := goEnv("GOVERSION"); v != "" {
+		report += "go command: " + v + "\n"
+	}
+	if errMsg != "" {
+		report += "\n" + errMsg + "\n"
+	}
+	w, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     path.Join(root, bundleReportFile),
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+	})
+	if err == nil {
+		_, err = io.WriteString(w, report)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() || d.Name() == lockFile {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if _, ok := extra[filepath.ToSlash(rel)]; ok {
+			return nil
+		}
+		return addToBundle(zw, path.Join(root, filepath.ToSlash(rel)), p)
+	})
+	if err != nil {
+		return err
+	}
+	for name, p := range extra {
+		err = addToBundle(zw, path.Join(root, name), p)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = zw.Close()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// addToBundle adds the file at p to zw, as name.
+func addToBundle(zw *zip.Writer, name, p string) error {
+	src, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	h, err := zip.FileInfoHeader(fi)
+	if err != nil {
+		return err
+	}
+	h.Name = name
+	h.Method = zip.Deflate
+	w, err := zw.CreateHeader(h)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, src)
+	return err
+}
+
+// shellQuoteArgs returns args as a command line for a shell.
+func shellQuoteArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = shellQuote(a)
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tmpDirRegexp matches the names of the temporary directories created by
+// makeTempDir.
+var tmpDirRegexp = regexp.MustCompile(`^go-bb-[0-9]+$`)
+
+// lockFile is the file of a temporary directory holding the process ID of the
+// go-bb run using it, so that -clean leaves it alone while the run goes on.
+const lockFile = ".go-bb.lock"
+
+// lockAge is how long -clean considers a temporary directory without
+// lockFile, from an older go-bb, in use after its last modification.
+const lockAge = time.Hour
+
+// makeTempDir creates a new temporary directory for go-bb, locked by the
+// current process.
+func makeTempDir() (string, error) {
+	dir, err := os.MkdirTemp("", "go-bb-*")
+	if err != nil {
+		return "", err
+	}
+	err = os.WriteFile(filepath.Join(dir, lockFile), []byte(strconv.Itoa(os.Getpid())), 0600)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// inUse reports whether the temporary directory dir is locked by a running
+// process, or was recently modified in the absence of lock.
+func inUse(dir string) bool {
+	b, err := os.ReadFile(filepath.Join(dir, lockFile))
+	if err != nil {
+		fi, err := os.Stat(dir)
+		return err == nil && time.Since(fi.ModTime()) < lockAge
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	return err == nil && processAlive(pid)
+}
+
+// cacheDir returns the directory go-bb keeps its cache in.
+func cacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "go-bb"), nil
+}
+
+// clean removes the temporary directories left in os.TempDir() by previous
+// runs, and the cache directory. Only directories whose name matches
+// tmpDirRegexp are considered, and those of running go-bb processes are
+// skipped.
+func clean() error {
+	var dirs []string
+	tmp := os.TempDir()
+	entries, err := os.ReadDir(tmp)
+	if err != nil {
+		return err
+	}
+	for _, x := range entries {
+		if !x.IsDir() || !tmpDirRegexp.MatchString(x.Name()) {
+			continue
+		}
+		dir := filepath.Join(tmp, x.Name())
+		if inUse(dir) {
+			fmt.Fprintf(logOut, "Skipped %s, in use\n", dir)
+			continue
+		}
+		dirs = append(dirs, dir)
+	}
+	if cache, err := cacheDir(); err == nil {
+		if fi, err := os.Stat(cache); err == nil && fi.IsDir() {
+			dirs = append(dirs, cache)
+		}
+	}
+
+	var total int64
+	for _, dir := range dirs {
+		size := dirSize(dir)
+		err := os.RemoveAll(dir)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(logOut, "Removed %s (%s)\n", dir, formatSize(size))
+		total += size
+	}
+	fmt.Fprintf(logOut, "Removed %d directories, reclaimed %s\n", len(dirs), formatSize(total))
+	return nil
+}
+
+// dirSize returns the total size of the regular files under dir. Errors are
+// ignored: the size is only reported.
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.Type().IsRegular() {
+			if fi, err := d.Info(); err == nil {
+				size += fi.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
+
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
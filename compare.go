@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines printed around the changes of
+// a disassembly diff.
+const diffContext = 3
+
+// compareCodegen builds the prepared module in dir a second time, with the
+// flags of buildArgs followed by extra, and prints the diff of the
+// disassembly of the functions named symbols between the binary at
+// binaryPath and the second one. buildArgs start with build -o BINARY.
+func compareCodegen(dir, binaryPath string, buildArgs, extra, symbols []string) error {
+	tmp, err := makeTempDir()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	other := filepath.Join(tmp, filepath.Base(binaryPath))
+	args := append([]string{"build", "-o", other}, buildArgs[3:]...)
+	args = append(args, extra...)
+	fmt.Fprintln(logOut, "Compiling with", strings.Join(extra, " "))
+	err = runGo(dir, args...)
+	if err != nil {
+		return err
+	}
+
+	for _, sym := range symbols {
+		before, err := disassemble(binaryPath, sym)
+		if err != nil {
+			return err
+		}
+		after, err := disassemble(other, sym)
+		if err != nil {
+			return err
+		}
+		name := sym[strings.LastIndex(sym, "/")+1:]
+		fmt.Fprintf(logOut, "--- %s\n+++ %s (%s)\n", name, name, strings.Join(extra, " "))
+		if !printDiff(before, after) {
+			fmt.Fprintln(logOut, "No difference")
+		}
+	}
+	return nil
+}
+
+// hexRegexp matches the hexadecimal numbers of an instruction, among which
+// branch targets.
+var hexRegexp = regexp.MustCompile(`0x[0-9a-f]+`)
+
+// disassemble returns the instructions of the function sym of the binary,
+// one "FILE:LINE INSTRUCTION" line each. Addresses are dropped, and the ones
+// within the function are replaced by offsets from its start, so that the
+// lines of two builds can be compared.
+func disassemble(binary, sym string) ([]string, error) {
+	out, err := exec.Command("go", "tool", "objdump", "-s", "^"+regexp.QuoteMeta(sym)+"$", binary).Output()
+	if err != nil {
+		return nil, fmt.Errorf("go tool objdump: %w", err)
+	}
+
+	type inst struct {
+		loc  string
+		addr uint64
+		text string
+	}
+	var insts []inst
+	for _, line := range strings.Split(string(out), "\n") {
+		// FILE:LINE, address, encoding and instruction, separated by
+		// tabs. The TEXT header line has none.
+		var fields []string
+		for _, f := range strings.Split(line, "\t") {
+			if f = strings.TrimSpace(f); f != "" {
+				fields = append(fields, f)
+			}
+		}
+		if len(fields) < 4 {
+			continue
+		}
+		addr, err := strconv.ParseUint(strings.TrimPrefix(fields[1], "0x"), 16, 64)
+		if err != nil {
+			continue
+		}
+		insts = append(insts, inst{fields[0], addr, fields[3]})
+	}
+	if len(insts) == 0 {
+		return nil, fmt.Errorf("no function %s in %s", sym, binary)
+	}
+
+	start, end := insts[0].addr, insts[len(insts)-1].addr
+	lines := make([]string, len(insts))
+	for i, x := range insts {
+		text := hexRegexp.ReplaceAllStringFunc(x.text, func(s string) string {
+			n, err := strconv.ParseUint(s[2:], 16, 64)
+			if err != nil || n < start || n > end {
+				return s
+			}
+			return fmt.Sprintf("+%#x", n-start)
+		})
+		lines[i] = x.loc + "\t" + text
+	}
+	return lines, nil
+}
+
+// printDiff prints the lines removed from a and added in b, with diffContext
+// lines around them, and reports whether there was any.
+func printDiff(a, b []string) bool {
+	// Longest common subsequence: lcs[i][j] is its length for a[i:]
+	// and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] > lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var lines []string
+	changed := false
+	for i, j := 0, 0; i < len(a) || j < len(b); {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, " "+a[i])
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, "-"+a[i])
+			changed = true
+			i++
+		default:
+			lines = append(lines, "+"+b[j])
+			changed = true
+			j++
+		}
+	}
+	if !changed {
+		return false
+	}
+
+	// Only print the unchanged lines close to a change, and elide the
+	// others.
+	elided := false
+	for i, line := range lines {
+		near := false
+		for k := i - diffContext; !near && k <= i+diffContext; k++ {
+			near = k >= 0 && k < len(lines) && lines[k][0] != ' '
+		}
+		if near {
+			fmt.Fprintln(logOut, line)
+			elided = false
+		} else if !elided {
+			fmt.Fprintln(logOut, "...")
+			elided = true
+		}
+	}
+	return true
+}
+
+// splitFlags splits s into fields separated by spaces, like a shell would:
+// single or double quotes keep spaces in a field.
+func splitFlags(s string) ([]string, error) {
+	var fields []string
+	var field strings.Builder
+	inField := false
+	var quote rune
+	for _, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				field.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inField = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteRune(r)
+			inField = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+	return fields, nil
+}
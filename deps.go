@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/build"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// depsReport is what -list-deps prints: what go-bb copies of the benchmarked
+// package, and what the prepared module gets from elsewhere.
+type depsReport struct {
+	Dir string `json:"dir"`
+	// Go files of Dir, copied whatever their build constraints.
+	Files []string `json:"files"`
+	// Directories copied as a whole.
+	Testdata []string `json:"testdata,omitempty"`
+	// Packages of the module of the benchmarked package it imports,
+	// directly or not, which are not copied.
+	ModulePackages []string `json:"module_packages,omitempty"`
+	// Other modules providing packages it imports, directly or not.
+	Modules []depsModule `json:"modules,omitempty"`
+}
+
+// depsModule is a module of a depsReport.
+type depsModule struct {
+	Path     string   `json:"path"`
+	Version  string   `json:"version,omitempty"`
+	Packages []string `json:"packages"`
+}
+
+// listDeps returns the depsReport of pkg. Its imports, and the imports of its
+// tests, are resolved by go list, from the module of pkg.
+func listDeps(pkg *build.Package) (depsReport, error) {
+	r := depsReport{Dir: pkg.Dir}
+	entries, err := os.ReadDir(pkg.Dir)
+	if err != nil {
+		return r, err
+	}
+	// As copyModuleToTmp does.
+	for _, x := range entries {
+		switch {
+		case x.IsDir() && x.Name() == "testdata":
+			r.Testdata = append(r.Testdata, x.Name())
+		case !x.IsDir() && strings.HasSuffix(x.Name(), ".go"):
+			r.Files = append(r.Files, x.Name())
+		}
+	}
+
+	cmd := exec.Command("go", "list", "-deps", "-test", "-json=ImportPath,Dir,Standard,ForTest,Module", ".")
+	cmd.Dir = pkg.Dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return r, fmt.Errorf("go list: %w\n%s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	type listedPackage struct {
+		ImportPath string
+		Dir        string
+		Standard   bool
+		ForTest    string
+		Module     *struct {
+			Path    string
+			Version string
+			Main    bool
+		}
+	}
+	modules := map[string]*depsModule{}
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for {
+		var p listedPackage
+		err := dec.Decode(&p)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return r, fmt.Errorf("go list: %w", err)
+		}
+		// The test variants of packages, and the test main package,
+		// are listed too.
+		if p.Standard || p.ForTest != "" || strings.HasSuffix(p.ImportPath, ".test") || p.Module == nil || p.Dir == pkg.Dir {
+			continue
+		}
+		switch {
+		case p.Module.Main:
+			r.ModulePackages = append(r.ModulePackages, p.ImportPath)
+		case modules[p.Module.Path] == nil:
+			modules[p.Module.Path] = &depsModule{Path: p.Module.Path, Version: p.Module.Version, Packages: []string{p.ImportPath}}
+		default:
+			m := modules[p.Module.Path]
+			m.Packages = append(m.Packages, p.ImportPath)
+		}
+	}
+
+	sort.Strings(r.ModulePackages)
+	for _, m := range modules {
+		sort.Strings(m.Packages)
+		r.Modules = append(r.Modules, *m)
+	}
+	sort.Slice(r.Modules, func(i, j int) bool {
+		return r.Modules[i].Path < r.Modules[j].Path
+	})
+	return r, nil
+}
+
+func (r depsReport) write(w io.Writer, format string) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	}
+	fmt.Fprintln(w, "Copied from", r.Dir+":")
+	for _, f := range r.Files {
+		fmt.Fprintln(w, "  "+f)
+	}
+	for _, d := range r.Testdata {
+		fmt.Fprintln(w, "  "+d+"/")
+	}
+	if len(r.ModulePackages) > 0 {
+		fmt.Fprintln(w, "Not copied, from the same module, resolved by go mod tidy like other dependencies:")
+		for _, p := range r.ModulePackages {
+			fmt.Fprintln(w, "  "+p)
+		}
+	}
+	if len(r.Modules) > 0 {
+		fmt.Fprintln(w, "Dependencies:")
+		for _, m := range r.Modules {
+			fmt.Fprintln(w, "  "+strings.TrimSpace(m.Path+" "+m.Version))
+			for _, p := range m.Packages {
+				fmt.Fprintln(w, "    "+p)
+			}
+		}
+	}
+	_, err := fmt.Fprintln(w, "Standard library packages are not listed.")
+	return err
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+// emitFuncs writes the rewritten benchmark functions of mod to a standalone
+// file at outPath, declaring the package they come from, with the imports they
+// need. GoBBN is replaced by a parameter, so that each is a plain
+// func(n int), and BenchmarkX is renamed RunX. The file also declares what
+// the functions use of the test files of the package, so that it compiles
+// with the other files of the package alone.
+func emitFuncs(mod preparedModule, outPath string) error {
+	xtest := mod.Functions[0].XTest
+	for _, f := range mod.Functions {
+		if f.XTest != xtest {
+			return fmt.Errorf("%s and %s are in different packages", mod.Functions[0].Name, f.Name)
+		}
+	}
+	dir := path.Join(mod.Dir, "bborig")
+	pkgName := mod.Package
+	if xtest {
+		dir = path.Join(dir, xtestDir)
+		pkgName += "_test"
+	}
+
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, dir, nil, parser.ParseComments)
+	if err != nil {
+		return err
+	}
+
+	// The rewritten copies of the helpers of the benchmarks, the names
+	// declared by the package, and the declarations of its test files.
+	copies := map[string]bool{}
+	declared := map[string]bool{}
+	testDecls := map[string][]fileDecl{}
+	var names []string
+	for _, pkg := range pkgs {
+		for name := range pkg.Files {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var x *ast.File
+		for _, pkg := range pkgs {
+			if pkg.Files[name] != nil {
+				x = pkg.Files[name]
+			}
+		}
+		isCopy := strings.HasPrefix(path.Base(name), helpersFilePrefix)
+		isTest := strings.HasSuffix(name, "_bborig.go")
+		for _, decl := range x.Decls {
+			for _, declName := range declNames(decl) {
+				declared[declName] = true
+				if isCopy {
+					copies[declName] = true
+				} else if isTest {
+					testDecls[declName] = append(testDecls[declName], fileDecl{x, decl})
+				}
+			}
+		}
+	}
+
+	var imports []string
+	seenImports := map[string]bool{}
+	addImports := func(file *ast.File) {
+		for _, spec := range file.Imports {
+			p, err := strconv.Unquote(spec.Path.Value)
+			if err != nil {
+				continue
+			}
+			if p == mod.bborigImport() {
+				p = mod.importPath()
+			}
+			s := strconv.Quote(p)
+			if spec.Name != nil {
+				s = spec.Name.Name + " " + s
+			}
+			if !seenImports[s] {
+				seenImports[s] = true
+				imports = append(imports, s)
+			}
+		}
+	}
+	var decls []string
+	var bodies []ast.Node
+	for _, f := range mod.Functions {
+		var file *ast.File
+		var d *ast.FuncDecl
+		for _, pkg := range pkgs {
+			for _, x := range pkg.Files {
+				if fd := findFuncDecl(x, f.symbol()); fd != nil {
+					file, d = x, fd
+				}
+			}
+		}
+		if d == nil {
+			return fmt.Errorf("could not find %s in %s", f.Name, dir)
+		}
+
+		addImports(file)
+
+		// Renamed, so as not to clash with the original benchmark.
+		d.Name.Name = emittedName(f.Name)
+		if declared[d.Name.Name] {
+			return fmt.Errorf("%s is renamed %s, which the package already declares", f.Name, d.Name.Name)
+		}
+		declared[d.Name.Name] = true
+		n := iterationsParam(d)
+		// The name the external test package refers to the copied
+		// package with, if it does.
+		qualifier := ""
+		for _, spec := range file.Imports {
+			if strings.Trim(spec.Path.Value, `"`) != mod.bborigImport() {
+				continue
+			}
+			qualifier = mod.Package
+			if spec.Name != nil {
+				qualifier = spec.Name.Name
+			}
+		}
+		astutil.Apply(d.Body, func(c *astutil.Cursor) bool {
+			switch v := c.Node().(type) {
+			case *ast.Ident:
+				if sel, ok := c.Parent().(*ast.SelectorExpr); ok && sel.Sel == v {
+					break
+				}
+				if v.Name == iterationsVar && v.Obj == nil {
+					c.Replace(ast.NewIdent(n))
+				}
+			case *ast.SelectorExpr:
+				if x, ok := v.X.(*ast.Ident); ok && qualifier != "" && x.Name == qualifier && v.Sel.Name == iterationsVar {
+					c.Replace(ast.NewIdent(n))
+					return false
+				}
+			}
+			return true
+		}, nil)
+		if usesParallelHooks(d.Body) {
+			return fmt.Errorf("%s runs a parallel benchmark, whose rewrite depends on code generated in the copied package", f.Name)
+		}
+		if name := calledCopy(d.Body, copies); name != "" {
+			return fmt.Errorf("%s calls %s, a helper rewritten in the copied package", f.Name, name)
+		}
+		if replaceFailHooks(d.Body, qualifier) && !seenImports[`"fmt"`] {
+			seenImports[`"fmt"`] = true
+			imports = append(imports, `"fmt"`)
+		}
+		d.Type.Params.List = []*ast.Field{{
+			Names: []*ast.Ident{ast.NewIdent(n)},
+			Type:  ast.NewIdent("int"),
+		}}
+
+		var buf bytes.Buffer
+		err = printer.Fprint(&buf, fset, &printer.CommentedNode{Node: d, Comments: file.Comments})
+		if err != nil {
+			return err
+		}
+		decls = append(decls, buf.String())
+		bodies = append(bodies, d.Body)
+	}
+
+	for _, x := range usedDecls(bodies, testDecls) {
+		addImports(x.file)
+		var buf bytes.Buffer
+		err = printer.Fprint(&buf, fset, &printer.CommentedNode{Node: x.decl, Comments: x.file.Comments})
+		if err != nil {
+			return err
+		}
+		decls = append(decls, buf.String())
+	}
+
+	var src bytes.Buffer
+	fmt.Fprintf(&src, "// Benchmarks extracted by go-bb from %s, RunX being BenchmarkX.\n// The number of iterations, b.N in the originals, is their parameter.\n\n", mod.importPath())
+	fmt.Fprintf(&src, "package %s\n\n", pkgName)
+	fmt.Fprintf(&src, "import (\n\t%s\n)\n\n", strings.Join(imports, "\n\t"))
+	src.WriteString(strings.Join(decls, "\n\n"))
+
+	f, err := parser.ParseFile(fset, outPath, src.Bytes(), parser.ParseComments)
+	if err != nil {
+		return fmt.Errorf("parsing extracted code: %w", err)
+	}
+	removeUnusedImports(fset, f)
+	var out bytes.Buffer
+	err = format.Node(&out, fset, f)
+	if err != nil {
+		return fmt.Errorf("formatting extracted code: %w", err)
+	}
+	err = os.MkdirAll(filepath.Dir(outPath), 0755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(outPath, out.Bytes(), 0644)
+}
+
+// emittedName returns the name of the emitted function of the benchmark
+// name: BenchmarkX becomes RunX.
+func emittedName(name string) string {
+	return "Run" + strings.TrimPrefix(name, "Benchmark")
+}
+
+// fileDecl is a top-level declaration, and the file it is in.
+type fileDecl struct {
+	file *ast.File
+	decl ast.Decl
+}
+
+// declNames returns the names that decl declares at the top level of a
+// package. Methods are declared under the name of their receiver type, so
+// that they come with it.
+func declNames(decl ast.Decl) []string {
+	var names []string
+	switch d := decl.(type) {
+	case *ast.FuncDecl:
+		if d.Recv == nil {
+			if d.Name.Name != "init" && d.Name.Name != "_" {
+				names = append(names, d.Name.Name)
+			}
+			break
+		}
+		t := d.Recv.List[0].Type
+		if star, ok := t.(*ast.StarExpr); ok {
+			t = star.X
+		}
+		if id, ok := t.(*ast.Ident); ok {
+			names = append(names, id.Name)
+		}
+	case *ast.GenDecl:
+		for _, spec := range d.Specs {
+			switch s := spec.(type) {
+			case *ast.TypeSpec:
+				names = append(names, s.Name.Name)
+			case *ast.ValueSpec:
+				for _, id := range s.Names {
+					if id.Name != "_" {
+						names = append(names, id.Name)
+					}
+				}
+			}
+		}
+	}
+	return names
+}
+
+// usedDecls returns the declarations of decls, keyed by the names they
+// declare, that roots use, directly or through other declarations of decls,
+// in the order they are found.
+func usedDecls(roots []ast.Node, decls map[string][]fileDecl) []fileDecl {
+	var used []fileDecl
+	seen := map[ast.Decl]bool{}
+	topLevel := map[interface{}]bool{}
+	for _, xs := range decls {
+		for _, x := range xs {
+			topLevel[x.decl] = true
+			if d, ok := x.decl.(*ast.GenDecl); ok {
+				for _, spec := range d.Specs {
+					topLevel[spec] = true
+				}
+			}
+		}
+	}
+	var visit func(root ast.Node)
+	visit = func(root ast.Node) {
+		ast.Inspect(root, func(n ast.Node) bool {
+			if sel, ok := n.(*ast.SelectorExpr); ok {
+				visit(sel.X)
+				return false
+			}
+			id, ok := n.(*ast.Ident)
+			if !ok || (id.Obj != nil && !topLevel[id.Obj.Decl]) {
+				return true
+			}
+			for _, x := range decls[id.Name] {
+				if !seen[x.decl] {
+					seen[x.decl] = true
+					used = append(used, x)
+					visit(x.decl)
+				}
+			}
+			return true
+		})
+	}
+	for _, root := range roots {
+		visit(root)
+	}
+	return used
+}
+
+// usesParallelHooks reports whether root refers to the hooks replacing
+// b.RunParallel and testing.PB.
+func usesParallelHooks(root ast.Node) bool {
+	hooks := map[string]bool{pbType: true}
+	for _, hook := range parallelMethods {
+		hooks[hook] = true
+	}
+	found := false
+	ast.Inspect(root, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok && id.Obj == nil && hooks[id.Name] {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+// replaceFailHooks replaces the calls of root of the hooks of failMethods, and
+// of the ones replacing b.Failed and b.Skipped, which are qualified by
+// qualifier if it is not "": failures and skips panic with their message, and
+// the outcome is false. It reports whether the replacements use fmt.
+func replaceFailHooks(root ast.Node, qualifier string) bool {
+	usesFmt := false
+	astutil.Apply(root, func(c *astutil.Cursor) bool {
+		call, ok := c.Node().(*ast.CallExpr)
+		if !ok {
+			return true
+		}
+		var name string
+		switch fun := call.Fun.(type) {
+		case *ast.Ident:
+			if fun.Obj != nil {
+				return true
+			}
+			name = fun.Name
+		case *ast.SelectorExpr:
+			x, ok := fun.X.(*ast.Ident)
+			if !ok || qualifier == "" || x.Name != qualifier {
+				return true
+			}
+			name = fun.Sel.Name
+		default:
+			return true
+		}
+
+		var msg ast.Expr
+		switch name {
+		case valueMethods["Failed"], valueMethods["Skipped"]:
+			c.Replace(ast.NewIdent("false"))
+			return false
+		case failMethods["Error"], failMethods["Fatal"], failMethods["Skip"]:
+			msg = &ast.CallExpr{Fun: &ast.SelectorExpr{X: ast.NewIdent("fmt"), Sel: ast.NewIdent("Sprint")}, Args: call.Args, Ellipsis: call.Ellipsis}
+		case failMethods["Errorf"], failMethods["Fatalf"], failMethods["Skipf"]:
+			msg = &ast.CallExpr{Fun: &ast.SelectorExpr{X: ast.NewIdent("fmt"), Sel: ast.NewIdent("Sprintf")}, Args: call.Args, Ellipsis: call.Ellipsis}
+		case failMethods["Fail"], failMethods["FailNow"]:
+			msg = &ast.BasicLit{Kind: token.STRING, Value: `"benchmark failed"`}
+		case failMethods["SkipNow"]:
+			msg = &ast.BasicLit{Kind: token.STRING, Value: `"benchmark skipped"`}
+		default:
+			return true
+		}
+		if _, ok := msg.(*ast.CallExpr); ok {
+			usesFmt = true
+		}
+		c.Replace(&ast.CallExpr{Fun: ast.NewIdent("panic"), Args: []ast.Expr{msg}})
+		return true
+	}, nil)
+	return usesFmt
+}
+
+// calledCopy returns the name of one of copies that root calls, or "".
+func calledCopy(root ast.Node, copies map[string]bool) string {
+	name := ""
+	ast.Inspect(root, func(n ast.Node) bool {
+		if call, ok := n.(*ast.CallExpr); ok {
+			if id, ok := call.Fun.(*ast.Ident); ok && id.Obj == nil && copies[id.Name] {
+				name = id.Name
+			}
+		}
+		return name == ""
+	})
+	return name
+}
+
+// iterationsParam returns a name for the parameter replacing GoBBN in d that
+// no identifier of d uses already.
+func iterationsParam(d *ast.FuncDecl) string {
+	return unusedName(d, "n", "iterations")
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"path"
+)
+
+// costEstimate is a rough, syntactic summary of the work a benchmark does per
+// iteration. It is a heuristic to help decide which benchmarks are worth
+// profiling, not a measurement.
+type costEstimate struct {
+	// True if the estimate covers the body of a b.N loop, false if no such
+	// loop was found and the whole function body was inspected.
+	inLoop    bool
+	loopDepth int
+	calls     int
+	allocs    int
+}
+
+// class buckets the estimate into a coarse category.
+func (e costEstimate) class() string {
+	switch {
+	case e.loopDepth == 0 && e.allocs == 0 && e.calls <= 2:
+		return "trivial"
+	case e.loopDepth <= 1 && e.allocs == 0 && e.calls <= 10:
+		return "light"
+	case e.loopDepth <= 2 && e.allocs <= 5:
+		return "moderate"
+	default:
+		return "heavy"
+	}
+}
+
+func (e costEstimate) print(w io.Writer, name string) {
+	fmt.Fprintf(w, "Estimated cost of %s (heuristic based on the source code, not a measurement):\n", name)
+	if e.inLoop {
+		fmt.Fprintln(w, "  inspected:   body of the b.N loop")
+	} else {
+		fmt.Fprintln(w, "  inspected:   whole function (no b.N loop found)")
+	}
+	fmt.Fprintln(w, "  loop depth: ", e.loopDepth)
+	fmt.Fprintln(w, "  calls:      ", e.calls)
+	fmt.Fprintln(w, "  allocations:", e.allocs)
+	fmt.Fprintln(w, "  cost class: ", e.class())
+}
+
+// estimateBenchFunc statically inspects the benchmark function described by
+// loc in the original package. Nothing is copied or built.
+func estimateBenchFunc(pkgDir string, loc fnLoc) (costEstimate, error) {
+	var est costEstimate
+
+	fset := token.NewFileSet()
+	fileAst, err := parser.ParseFile(fset, path.Join(pkgDir, loc.file), nil, 0)
+	if err != nil {
+		return est, err
+	}
+
+	d := findFuncDecl(fileAst, loc.name)
+	if d == nil {
+		return est, fmt.Errorf("could not find declaration of %s", loc.name)
+	}
+	if d.Type.Params.NumFields() != 1 || len(d.Type.Params.List[0].Names) != 1 {
+		return est, fmt.Errorf("function %s is expected to have exactly one named parameter", loc.name)
+	}
+	testingBIdent := d.Type.Params.List[0].Names[0]
+	rewriteLoopCalls(d.Body, testingBIdent)
+
+	var root ast.Node = d.Body
+	ast.Inspect(d.Body, func(n ast.Node) bool {
+		if est.inLoop {
+			return false
+		}
+		switch v := n.(type) {
+		case *ast.ForStmt:
+			if isBenchLoop(v, testingBIdent) {
+				root = v.Body
+				est.inLoop = true
+				return false
+			}
+		case *ast.RangeStmt:
+			if isBenchRange(v, testingBIdent) {
+				root = v.Body
+				est.inLoop = true
+				return false
+			}
+		}
+		return true
+	})
+
+	est.walk(root, testingBIdent, 0)
+	return est, nil
+}
+
+func (e *costEstimate) walk(root ast.Node, id *ast.Ident, depth int) {
+	ast.Inspect(root, func(n ast.Node) bool {
+		if n == root {
+			return true
+		}
+		switch v := n.(type) {
+		case *ast.ForStmt, *ast.RangeStmt:
+			if depth+1 > e.loopDepth {
+				e.loopDepth = depth + 1
+			}
+			e.walk(n, id, depth+1)
+			return false
+		case *ast.CallExpr:
+			if sel, ok := v.Fun.(*ast.SelectorExpr); ok {
+				if ident, ok := sel.X.(*ast.Ident); ok && ident.Obj == id.Obj {
+					// Calls to the testing.B are removed by the rewrite.
+					return false
+				}
+			}
+			if ident, ok := v.Fun.(*ast.Ident); ok && ident.Obj == nil {
+				switch ident.Name {
+				case "make", "new", "append":
+					e.allocs++
+					return true
+				case "len", "cap", "copy", "delete", "panic", "print", "println":
+					return true
+				}
+			}
+			e.calls++
+		case *ast.UnaryExpr:
+			if _, ok := v.X.(*ast.CompositeLit); ok && v.Op == token.AND {
+				e.allocs++
+			}
+		case *ast.FuncLit:
+			e.allocs++
+		}
+		return true
+	})
+}
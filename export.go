@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/build"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// preparedModuleFile is the name of the file go-bb writes at the root of an
+// exported module, to recognize it when it is reused.
+const preparedModuleFile = "go-bb.json"
+
+// preparedModule is a module containing a copy of the benchmarked package,
+// with the benchmark functions rewritten, from which the benchmark binary is
+// built.
+type preparedModule struct {
+	Dir string `json:"-"`
+	// Module path of the module.
+	Module string `json:"module"`
+	// Name of the copied package, at Module/bborig.
+	Package string `json:"package"`
+	// Rewritten benchmark functions.
+	Functions []preparedFunc `json:"functions"`
+	// The -n flag the benchmarks were selected with.
+	Pattern string `json:"pattern,omitempty"`
+	// True if main dispatches to one of the functions by name.
+	Multi bool `json:"multi"`
+	// True if the benchmark loops were instrumented for -latency.
+	Latency bool `json:"latency"`
+	// True if b was rebound to the stub type instead of being removed.
+	InlineStubs bool `json:"inline_stubs,omitempty"`
+	// True if the calls of b.Log and b.Logf were kept for -keep-logs.
+	KeepLogs bool `json:"keep_logs,omitempty"`
+	// True if the calls of the timer methods of b were replaced for
+	// -timer-labels.
+	TimerLabels bool `json:"timer_labels,omitempty"`
+	// True if the calls of runtime.GC and runtime.Gosched were removed for
+	// -strip-runtime-hints.
+	StripRuntimeHints bool `json:"strip_runtime_hints,omitempty"`
+	// True if the calls of the bookkeeping methods of b were removed for
+	// -strip-benchmem-helpers.
+	StripBenchmemHelpers bool `json:"strip_benchmem_helpers,omitempty"`
+	// True if the rewrite was checked with -strict.
+	Strict bool `json:"strict,omitempty"`
+	// Import paths the benchmarked package was known as.
+	OrigImportPaths []string `json:"orig_import_paths"`
+	// Directory of the benchmarked package.
+	OrigDir string `json:"orig_dir"`
+	// With -local-module, path and directory of the benchmarked module,
+	// which the module requires through a replace directive.
+	LocalModule    string `json:"local_module,omitempty"`
+	LocalModuleDir string `json:"local_module_dir,omitempty"`
+	// Changes of the rewrite to the benchmarks and their helpers.
+	Rewrites []rewriteChange `json:"rewrites,omitempty"`
+	// When the module is reused, the files generated for this build, which
+	// replace the ones of the module with -overlay, by path relative to
+	// Dir.
+	Overlay map[string]string `json:"-"`
+}
+
+// preparedFunc is a rewritten benchmark function of a preparedModule.
+type preparedFunc struct {
+	Name string `json:"name"`
+	// True if the function is part of the external test package, in the
+	// xtest directory of the copied package.
+	XTest bool `json:"xtest,omitempty"`
+	// Name of the function in the copied package, if it was renamed with
+	// -symbol.
+	Symbol string `json:"symbol,omitempty"`
+}
+
+// symbol returns the name of f in the copied package.
+func (f preparedFunc) symbol() string {
+	if f.Symbol != "" {
+		return f.Symbol
+	}
+	return f.Name
+}
+
+// bborigImport returns the import path of the copied package.
+func (mod preparedModule) bborigImport() string {
+	return mod.Module + "/bborig"
+}
+
+// importPath returns the import path of the benchmarked package, preferring
+// the resolved one when it was given as a local path.
+func (mod preparedModule) importPath() string {
+	for i := len(mod.OrigImportPaths) - 1; i >= 0; i-- {
+		if p := mod.OrigImportPaths[i]; !build.IsLocalImport(p) {
+			return p
+		}
+	}
+	return mod.Package
+}
+
+// functionNames returns the names the benchmarks of mod are selected with.
+// A benchmark of the external test package named like one of the package
+// itself is qualified with the name of its package, foo_test.BenchmarkX.
+func (mod preparedModule) functionNames() []string {
+	internal := map[string]bool{}
+	for _, f := range mod.Functions {
+		if !f.XTest {
+			internal[f.Name] = true
+		}
+	}
+	names := make([]string, 0, len(mod.Functions))
+	for _, f := range mod.Functions {
+		name := f.Name
+		if f.XTest && internal[name] {
+			name = mod.Package + "_test." + name
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// origSymbol rewrites the symbol name of a function of the copied packages so
+// that it refers to the benchmarked package instead, or to its external test
+// package. Other names are returned as is.
+func (mod preparedModule) origSymbol(name string) string {
+	xtest := mod.bborigImport() + "/" + xtestDir + "."
+	if strings.HasPrefix(name, xtest) {
+		return mod.importPath() + "_test." + name[len(xtest):]
+	}
+	if p := mod.bborigImport() + "."; strings.HasPrefix(name, p) {
+		return mod.importPath() + "." + name[len(p):]
+	}
+	return name
+}
+
+// origPositionRegexp matches the file part of positions in the copied
+// package, as printed by the go command.
+var origPositionRegexp = regexp.MustCompile(`(?m)(^|\s)(\./)?bborig/([^\s:]+\.go):`)
+
+// origPositions rewrites the positions in the copied package found in the
+// output of a go command run in the module, so that they refer to the files of
+// the benchmarked package instead. Line numbers are left as is, so they may be
+// off in the rewritten files.
+func (mod preparedModule) origPositions(out string) string {
+	if mod.OrigDir == "" {
+		return out
+	}
+	return origPositionRegexp.ReplaceAllStringFunc(out, func(m string) string {
+		sub := origPositionRegexp.FindStringSubmatch(m)
+		name := strings.Replace(sub[3], "_bborig.go", "_test.go", 1)
+		name = strings.TrimPrefix(name, xtestDir+"/")
+		return sub[1] + path.Join(mod.OrigDir, name) + ":"
+	})
+}
+
+func writePreparedModule(mod preparedModule) error {
+	data, err := json.MarshalIndent(mod, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path.Join(mod.Dir, preparedModuleFile), append(data, '\n'), 0644)
+}
+
+// writeOverlay writes the -overlay file of the go command replacing the files
+// of mod by the ones of mod.Overlay to p.
+func writeOverlay(mod preparedModule, p string) error {
+	replace := map[string]string{}
+	for name, file := range mod.Overlay {
+		replace[path.Join(mod.Dir, name)] = file
+	}
+	data, err := json.Marshal(struct{ Replace map[string]string }{replace})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(p, data, 0644)
+}
+
+// readPreparedModule reads the description of the module exported in dir.
+// It returns false if dir does not contain an exported module.
+func readPreparedModule(dir string) (preparedModule, bool, error) {
+	mod := preparedModule{Dir: dir}
+	data, err := os.ReadFile(path.Join(dir, preparedModuleFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return mod, false, nil
+	}
+	if err != nil {
+		return mod, false, err
+	}
+	err = json.Unmarshal(data, &mod)
+	if err != nil {
+		return mod, false, fmt.Errorf("parsing %s: %w", preparedModuleFile, err)
+	}
+	if len(mod.Functions) == 0 {
+		return mod, false, fmt.Errorf("%s does not list any benchmark function", preparedModuleFile)
+	}
+	return mod, true, nil
+}
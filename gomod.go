@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/build"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// localVersion is the version the temporary module requires the benchmarked
+// module at with -local-module, which a replace directive points to its
+// directory.
+const localVersion = "v0.0.0-00010101000000-000000000000"
+
+// goModFile is the part of the output of go mod edit -json that go-bb uses:
+// the module path, and what is copied to the temporary module.
+type goModFile struct {
+	Module    moduleVersion
+	Go        string
+	Toolchain string
+	Require   []moduleVersion
+	Exclude   []moduleVersion
+	Replace   []struct {
+		Old, New moduleVersion
+	}
+}
+
+type moduleVersion struct {
+	Path, Version string
+}
+
+func (m moduleVersion) String() string {
+	if m.Version == "" {
+		return m.Path
+	}
+	return m.Path + "@" + m.Version
+}
+
+// origGoMod returns the path of the go.mod file of the module of the package
+// in dir, or "" if it is not part of a module.
+func origGoMod(dir string) string {
+	cmd := exec.Command("go", "env", "GOMOD")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	p := strings.TrimSpace(string(out))
+	if p == os.DevNull {
+		return ""
+	}
+	return p
+}
+
+// internalImport returns one of the internal packages pkg or its tests
+// import, which the copied package can only import from within the path of
+// the module, or "".
+func internalImport(pkg *build.Package) string {
+	for _, imports := range [][]string{pkg.Imports, pkg.TestImports, pkg.XTestImports} {
+		for _, p := range imports {
+			for _, elem := range strings.Split(p, "/") {
+				if elem == "internal" {
+					return p
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// missingPackageRegexp matches the error of go mod tidy about a package no
+// module provides.
+var missingPackageRegexp = regexp.MustCompile(`cannot find module providing package ([^\s:]+)`)
+
+// localModuleHint returns a hint to use -local-module if tidyErr, the error of
+// go mod tidy, is about a package of the module of the package in dir, which
+// the temporary module does not require, or "".
+func localModuleHint(tidyErr error, dir string) string {
+	m := missingPackageRegexp.FindStringSubmatch(tidyErr.Error())
+	if m == nil {
+		return ""
+	}
+	goMod := origGoMod(dir)
+	if goMod == "" {
+		return ""
+	}
+	f, err := readGoMod(goMod)
+	if err != nil || (m[1] != f.Module.Path && !strings.HasPrefix(m[1], f.Module.Path+"/")) {
+		return ""
+	}
+	return fmt.Sprintf("%s is a package of %s, the benchmarked module: use -local-module to build against the module as it is on disk.", m[1], f.Module.Path)
+}
+
+// readGoMod parses the go.mod file at goMod.
+func readGoMod(goMod string) (goModFile, error) {
+	var f goModFile
+	out, err := exec.Command("go", "mod", "edit", "-json", goMod).Output()
+	if err != nil {
+		return f, err
+	}
+	err = json.Unmarshal(out, &f)
+	return f, err
+}
+
+// requireLocalModule makes the module in dir require the module at path,
+// replaced by its directory, localDir.
+func requireLocalModule(dir, path, localDir string) error {
+	return runGo(dir, "mod", "edit", "-require="+path+"@"+localVersion, "-replace="+path+"="+localDir)
+}
+
+// copyRequirements copies the go and toolchain directives, the requirements,
+// exclusions and replacements of the go.mod file at goMod, and the go.sum file
+// next to it, to the module in dir, so that it builds against the versions
+// of the dependencies the benchmarked module requires. The local paths of the
+// replacements are made absolute.
+func copyRequirements(goMod, dir string) error {
+	f, err := readGoMod(goMod)
+	if err != nil {
+		return err
+	}
+
+	args := []string{"mod", "edit"}
+	if f.Go != "" {
+		args = append(args, "-go="+f.Go)
+	}
+	if f.Toolchain != "" {
+		args = append(args, "-toolchain="+f.Toolchain)
+	}
+	for _, r := range f.Require {
+		args = append(args, "-require="+r.String())
+	}
+	for _, e := range f.Exclude {
+		args = append(args, "-exclude="+e.String())
+	}
+	for _, r := range f.Replace {
+		if r.New.Version == "" && !filepath.IsAbs(r.New.Path) {
+			r.New.Path = filepath.Join(filepath.Dir(goMod), r.New.Path)
+		}
+		args = append(args, "-replace="+r.Old.String()+"="+r.New.String())
+	}
+	if len(args) > 2 {
+		err = runGo(dir, args...)
+		if err != nil {
+			return err
+		}
+	}
+
+	sum := filepath.Join(filepath.Dir(goMod), "go.sum")
+	if _, err := os.Stat(sum); err != nil {
+		return nil
+	}
+	return copyFile(sum, filepath.Join(dir, "go.sum"))
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/format"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// helpersFilePrefix is the prefix of the files generated in the copied
+// package holding the copies of the helpers of the benchmarks.
+const helpersFilePrefix = "zz_gobb_helpers_"
+
+// benchHelper is a package-level function of the copied package taking a
+// *testing.B, which the benchmarks may call with their b.
+type benchHelper struct {
+	decl *ast.FuncDecl
+	file *ast.File
+	// Name of the file, relative to the directory of the package.
+	fileName string
+	// Index of the *testing.B parameter among the parameters.
+	param int
+}
+
+// findBenchHelpers returns the package-level functions of the package
+// pkgName in dir that take exactly one *testing.B parameter, by name.
+func findBenchHelpers(fset *token.FileSet, dir, pkgName string) (map[string]*benchHelper, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	helpers := map[string]*benchHelper{}
+	for _, x := range files {
+		name := x.Name()
+		if x.IsDir() || !strings.HasSuffix(name, ".go") || strings.HasPrefix(name, helpersFilePrefix) || name == hooksFileName {
+			continue
+		}
+		if ok, err := build.Default.MatchFile(dir, name); err != nil || !ok {
+			continue
+		}
+		f, err := parser.ParseFile(fset, path.Join(dir, name), nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		testingName := importName(f, "testing")
+		if f.Name.Name != pkgName || testingName == "" {
+			continue
+		}
+		for _, decl := range f.Decls {
+			fd, ok := decl.(*ast.FuncDecl)
+			if !ok || fd.Recv != nil || fd.Body == nil {
+				continue
+			}
+			param, count, i := -1, 0, 0
+			for _, field := range fd.Type.Params.List {
+				n := len(field.Names)
+				if n == 0 {
+					n = 1
+				}
+				if isTestingBPointer(field.Type, testingName) {
+					param = i
+					count += n
+				}
+				i += n
+			}
+			if count == 1 {
+				helpers[fd.Name.Name] = &benchHelper{decl: fd, file: f, fileName: name, param: param}
+			}
+		}
+	}
+	return helpers, nil
+}
+
+// isTestingBPointer reports whether x is *testing.B, the testing package
+// being imported as testingName.
+func isTestingBPointer(x ast.Expr, testingName string) bool {
+	star, ok := x.(*ast.StarExpr)
+	if !ok {
+		return false
+	}
+	sel, ok := star.X.(*ast.SelectorExpr)
+	if !ok || sel.Sel.Name != "B" {
+		return false
+	}
+	ident, ok := sel.X.(*ast.Ident)
+	return ok && ident.Name == testingName && ident.Obj == nil
+}
+
+// helperCopyName returns the name of the rewritten copy of the helper name.
+func helperCopyName(name string) string {
+	return "gobb" + strings.ToUpper(name[:1]) + name[1:]
+}
+
+// redirectHelperCalls makes the calls of body passing id as the *testing.B of
+// one of helpers call its rewritten copy instead, directly or through a local
+// variable bound to the helper once (work := helper) and only called with id,
+// which is bound to the copy instead. Without stubs, id is not passed anymore,
+// since the copy does not take it. It returns the names of the helpers
+// called, and the calls.
+func redirectHelperCalls(body *ast.BlockStmt, id *ast.Ident, helpers map[string]*benchHelper, stubs bool) ([]string, map[*ast.CallExpr]bool) {
+	var names []string
+	calls := map[*ast.CallExpr]bool{}
+	vars := helperVars(body, id, helpers)
+	ast.Inspect(body, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok {
+			return true
+		}
+		fun, ok := call.Fun.(*ast.Ident)
+		if !ok {
+			return true
+		}
+		name := fun.Name
+		v := vars[fun.Obj]
+		if v != nil {
+			name = v.helper
+		} else if fun.Obj != nil && fun.Obj.Kind != ast.Fun {
+			return true
+		}
+		h := helpers[name]
+		if h == nil || call.Ellipsis.IsValid() || len(call.Args) <= h.param {
+			return true
+		}
+		if arg, ok := call.Args[h.param].(*ast.Ident); !ok || arg.Obj != id.Obj {
+			return true
+		}
+		names = append(names, name)
+		if v != nil {
+			v.value.Name = helperCopyName(name)
+			v.value.Obj = nil
+		} else {
+			fun.Name = helperCopyName(name)
+			fun.Obj = nil
+		}
+		if !stubs {
+			call.Args = append(call.Args[:h.param:h.param], call.Args[h.param+1:]...)
+		}
+		calls[call] = true
+		return true
+	})
+	return names, calls
+}
+
+// helperVar is a local variable bound to a helper: value, in its
+// declaration, refers to the helper named helper.
+type helperVar struct {
+	helper string
+	value  *ast.Ident
+}
+
+// helperVars returns the local variables of body declared by x := helper, for
+// one of helpers, which are not assigned again and only called with id as
+// the *testing.B of the helper, by object.
+func helperVars(body *ast.BlockStmt, id *ast.Ident, helpers map[string]*benchHelper) map[*ast.Object]*helperVar {
+	vars := map[*ast.Object]*helperVar{}
+	ast.Inspect(body, func(n ast.Node) bool {
+		as, ok := n.(*ast.AssignStmt)
+		if !ok || as.Tok != token.DEFINE || len(as.Lhs) != 1 || len(as.Rhs) != 1 {
+			return true
+		}
+		x, ok := as.Lhs[0].(*ast.Ident)
+		if !ok || x.Obj == nil {
+			return true
+		}
+		value, ok := as.Rhs[0].(*ast.Ident)
+		if !ok || value.Obj != nil && value.Obj.Kind != ast.Fun {
+			return true
+		}
+		h := helpers[value.Name]
+		if h != nil && !isReassigned(body, x, as) && onlyCalledWith(body, x, as, id, h.param) {
+			vars[x.Obj] = &helperVar{helper: value.Name, value: value}
+		}
+		return true
+	})
+	return vars
+}
+
+// onlyCalledWith reports whether the variable x, declared by decl, is only
+// used in body as the function of calls passing id as argument i.
+func onlyCalledWith(body *ast.BlockStmt, x *ast.Ident, decl ast.Stmt, id *ast.Ident, i int) bool {
+	called := map[*ast.Ident]bool{}
+	ast.Inspect(body, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok || call.Ellipsis.IsValid() || len(call.Args) <= i {
+			return true
+		}
+		fun, ok := call.Fun.(*ast.Ident)
+		if arg, isIdent := call.Args[i].(*ast.Ident); ok && isIdent && fun.Obj == x.Obj && arg.Obj == id.Obj {
+			called[fun] = true
+		}
+		return true
+	})
+	ok := true
+	ast.Inspect(body, func(n ast.Node) bool {
+		if n == decl {
+			return false
+		}
+		if y, isIdent := n.(*ast.Ident); isIdent && y.Obj == x.Obj && !called[y] {
+			ok = false
+		}
+		return ok
+	})
+	return ok
+}
+
+// rewriteHelpers writes the rewritten copies of the helpers named names, and
+// of the helpers they call in turn, to dir, the directory of the package
+// pkgName, one file per file declaring them, named after the benchmark bench.
+// Their *testing.B parameter is rewritten like the one of the benchmark.
+// Copies written for another benchmark already are reused.
+func rewriteHelpers(fset *token.FileSet, dir, pkgName, bench string, names []string, helpers map[string]*benchHelper, wrappers map[string][]string, opts rewriteOptions) error {
+	var files []*helpersFile
+	byName := map[string]*helpersFile{}
+	done := map[string]bool{}
+	for len(names) > 0 {
+		name := names[0]
+		names = names[1:]
+		if done[name] {
+			continue
+		}
+		done[name] = true
+
+		copyName := helperCopyName(name)
+		pos, err := findPackageDecl(dir, copyName)
+		if err != nil {
+			return err
+		}
+		if pos.IsValid() {
+			if strings.HasPrefix(filepath.Base(pos.Filename), helpersFilePrefix) {
+				continue
+			}
+			return fmt.Errorf("cannot copy the helper %s as %s, which is already declared at %s", name, copyName, pos)
+		}
+
+		h := helpers[name]
+		d := h.decl
+		field, index, err := helperParam(d, h.param)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(logOut, "Rewriting helper function %s as %s\n", name, copyName)
+		opts.recordChange(d.Pos(), "copied %s as %s, called by %s", name, copyName, bench)
+		d.Name.Name = copyName
+		if index < len(field.Names) && field.Names[index].Name != "_" {
+			id := field.Names[index]
+			if call := findAlteringCall(d.Body, id); opts.strict && opts.stubType == "" && call != nil {
+				method := call.Fun.(*ast.SelectorExpr).Sel.Name
+				return errors.New(withSnippet(fmt.Sprintf("%s:%d: %s, a helper of %s, calls %s.%s, which the rewrite cannot keep: %s; rejected by -strict", h.fileName, fset.Position(call.Pos()).Line, name, bench, id.Name, method, alteringMethods[method]), fset, call.Pos()))
+			}
+			for _, pos := range rewriteLoopCalls(d.Body, id) {
+				opts.recordChange(pos, "rewrote for %s.Loop() as a loop bounded by %s.N", id.Name, id.Name)
+			}
+			called, calls := redirectHelperCalls(d.Body, id, helpers, opts.stubType != "")
+			names = append(names, called...)
+			d.Body = removeReferencesToIdentifier(fset, id, d.Body, opts).(*ast.BlockStmt)
+			if sel := findUnknownMethod(d.Body, id); opts.stubType != "" && sel != nil {
+				return errors.New(withSnippet(fmt.Sprintf("%s:%d: %s, a helper of %s, uses %s.%s, which %s does not provide; this is not supported", h.fileName, fset.Position(sel.Pos()).Line, name, bench, id.Name, sel.Sel.Name, opts.stubType), fset, sel.Pos()))
+			}
+			if pos, wrapper := findRemainingRef(d.Body, id, wrappers, calls, opts.stubType != ""); pos.IsValid() {
+				line := fset.Position(pos).Line
+				if wrapper != "" {
+					return errors.New(withSnippet(fmt.Sprintf("%s:%d: %s wraps %s in %s, a type holding a testing.B; helpers using such wrappers are not supported", h.fileName, line, name, id.Name, wrapper), fset, pos))
+				}
+				if call := findMethodValue(d.Body, pos); call != nil {
+					method := call.Fun.(*ast.SelectorExpr).Sel.Name
+					return errors.New(withSnippet(fmt.Sprintf("%s:%d: %s, a helper of %s, uses the result of %s.%s, which the rewrite has no replacement for; %s", h.fileName, line, name, bench, id.Name, method, unsupportedMethodValue(method)), fset, pos))
+				}
+				return errors.New(withSnippet(fmt.Sprintf("%s:%d: %s, a helper of %s, uses %s other than through %s.N, a method call or a call of another helper; this is not supported", h.fileName, line, name, bench, id.Name, id.Name), fset, pos))
+			}
+		}
+		replaceTestingTypes(h.file, d.Body, opts)
+		if pos := findTestingBTypeRef(h.file, d.Body); pos.IsValid() {
+			return errors.New(withSnippet(fmt.Sprintf("%s:%d: %s, a helper of %s, refers to the testing.B type in its body; this is not supported", h.fileName, fset.Position(pos).Line, name, bench), fset, pos))
+		}
+		if opts.stubType != "" {
+			field.Type = &ast.StarExpr{Star: field.Type.Pos(), X: opts.hookRef(field.Type.Pos(), opts.stubType)}
+		} else {
+			removeHelperParam(d, field, index)
+		}
+
+		hf := byName[h.fileName]
+		if hf == nil {
+			hf = &helpersFile{source: h.fileName, seenImports: map[string]bool{}}
+			byName[h.fileName] = hf
+			files = append(files, hf)
+		}
+		var buf bytes.Buffer
+		err = printer.Fprint(&buf, fset, d)
+		if err != nil {
+			return err
+		}
+		hf.decls = append(hf.decls, buf.String())
+		hf.cgo = hf.cgo || usesCgo(d)
+		for _, spec := range h.file.Imports {
+			s := spec.Path.Value
+			if s == `"C"` {
+				continue
+			}
+			if spec.Name != nil {
+				s = spec.Name.Name + " " + s
+			}
+			if !hf.seenImports[s] {
+				hf.seenImports[s] = true
+				hf.imports = append(hf.imports, s)
+			}
+		}
+	}
+	for _, hf := range files {
+		if opts.hooksImport != "" {
+			hf.imports = append(hf.imports, opts.hooksQualifier+" "+strconv.Quote(opts.hooksImport))
+		}
+		err := writeHelpersFile(fset, dir, pkgName, bench, hf)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// helpersFile is a generated file of copies of helpers, all declared in the
+// file source of the package.
+type helpersFile struct {
+	source      string
+	decls       []string
+	imports     []string
+	seenImports map[string]bool
+	// Whether the copies refer to the C pseudo-package of cgo.
+	cgo bool
+}
+
+// helpersFileName returns the name of the file of the copies of the helpers
+// of bench declared in the file source. It ends like the name of source, from
+// its first underscore on, so that the GOOS and GOARCH suffixes of source, if
+// any, constrain it the same way.
+func helpersFileName(bench, source string) string {
+	stem := strings.TrimSuffix(strings.TrimSuffix(source, ".go"), "_test")
+	suffix := ""
+	if i := strings.Index(stem, "_"); i >= 0 {
+		stem, suffix = stem[:i], stem[i:]
+	}
+	return helpersFilePrefix + bench + "_" + stem + "_gen" + suffix + ".go"
+}
+
+// writeHelpersFile writes hf, the copies of the helpers of bench, to dir, the
+// directory of the package pkgName. The file gets the build constraints of
+// the file the helpers are copied from, and its cgo preamble if the copies
+// use cgo.
+func writeHelpersFile(fset *token.FileSet, dir, pkgName, bench string, hf *helpersFile) error {
+	constraints, preamble, err := fileHeader(path.Join(dir, hf.source))
+	if err != nil {
+		return err
+	}
+
+	filePath := path.Join(dir, helpersFileName(bench, hf.source))
+	var src bytes.Buffer
+	src.WriteString("// Code generated by go-bb. DO NOT EDIT.\n\n")
+	if len(constraints) > 0 {
+		fmt.Fprintf(&src, "%s\n\n", strings.Join(constraints, "\n"))
+	}
+	fmt.Fprintf(&src, "package %s\n\n", pkgName)
+	if hf.cgo {
+		fmt.Fprintf(&src, "%simport \"C\"\n\n", preamble)
+	}
+	fmt.Fprintf(&src, "import (\n\t%s\n)\n\n", strings.Join(hf.imports, "\n\t"))
+	src.WriteString(strings.Join(hf.decls, "\n\n"))
+
+	f, err := parser.ParseFile(fset, filePath, src.Bytes(), parser.ParseComments)
+	if err != nil {
+		return fmt.Errorf("parsing the rewritten helpers: %w", err)
+	}
+	removeUnusedImports(fset, f)
+	var out bytes.Buffer
+	err = format.Node(&out, fset, f)
+	if err != nil {
+		return fmt.Errorf("formatting the rewritten helpers: %w", err)
+	}
+	return os.WriteFile(filePath, out.Bytes(), 0644)
+}
+
+// fileHeader returns the build constraint lines of the Go file at filePath,
+// and the comment preceding its import "C", the cgo preamble, if any.
+func fileHeader(filePath string) ([]string, string, error) {
+	f, err := parser.ParseFile(token.NewFileSet(), filePath, nil, parser.ImportsOnly|parser.ParseComments)
+	if err != nil {
+		return nil, "", err
+	}
+	var constraints []string
+	for _, cg := range f.Comments {
+		if cg.Pos() > f.Package {
+			break
+		}
+		for _, c := range cg.List {
+			if strings.HasPrefix(c.Text, "//go:build") || strings.HasPrefix(c.Text, "// +build") {
+				constraints = append(constraints, c.Text)
+			}
+		}
+	}
+	var preamble strings.Builder
+	for _, decl := range f.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.IMPORT {
+			continue
+		}
+		for _, spec := range gd.Specs {
+			is := spec.(*ast.ImportSpec)
+			if is.Path.Value != `"C"` {
+				continue
+			}
+			doc := is.Doc
+			if doc == nil && len(gd.Specs) == 1 {
+				doc = gd.Doc
+			}
+			if doc != nil {
+				for _, c := range doc.List {
+					preamble.WriteString(c.Text + "\n")
+				}
+			}
+		}
+	}
+	return constraints, preamble.String(), nil
+}
+
+// usesCgo reports whether d refers to the C pseudo-package of cgo.
+func usesCgo(d *ast.FuncDecl) bool {
+	found := false
+	ast.Inspect(d, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			if x, ok := sel.X.(*ast.Ident); ok && x.Name == "C" && x.Obj == nil {
+				found = true
+			}
+		}
+		return !found
+	})
+	return found
+}
+
+// helperParam returns the field of the parameters of d declaring the
+// parameter at index i, and the index of its name in the field.
+func helperParam(d *ast.FuncDecl, i int) (*ast.Field, int, error) {
+	param := i
+	for _, field := range d.Type.Params.List {
+		n := len(field.Names)
+		if n == 0 {
+			n = 1
+		}
+		if i < n {
+			return field, i, nil
+		}
+		i -= n
+	}
+	return nil, 0, fmt.Errorf("%s has no parameter at index %d", d.Name.Name, param)
+}
+
+// removeHelperParam removes the parameter of d whose name is at index in
+// field.
+func removeHelperParam(d *ast.FuncDecl, field *ast.Field, index int) {
+	if len(field.Names) > 1 {
+		field.Names = append(field.Names[:index:index], field.Names[index+1:]...)
+		return
+	}
+	params := d.Type.Params
+	for i, f := range params.List {
+		if f == field {
+			params.List = append(params.List[:i:i], params.List[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"text/template"
+)
+
+// hookContext is the data the arguments of -after-build are expanded with.
+type hookContext struct {
+	// Absolute path of the benchmark binary.
+	Binary string
+	GOOS   string
+	GOARCH string
+}
+
+// hookResult is the outcome of the -after-build command.
+type hookResult struct {
+	Command  []string `json:"command"`
+	ExitCode int      `json:"exit_code"`
+	// Standard output and error of the command, interleaved.
+	Output string `json:"output,omitempty"`
+}
+
+// parseHook splits the -after-build command line s into templates of its
+// arguments.
+func parseHook(s string) ([]*template.Template, error) {
+	fields, err := splitFlags(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, errors.New("empty command")
+	}
+	tmpls := make([]*template.Template, len(fields))
+	for i, f := range fields {
+		tmpls[i], err = template.New("after-build").Option("missingkey=error").Parse(f)
+		if err == nil {
+			// Catch unknown fields before building anything.
+			err = tmpls[i].Execute(io.Discard, hookContext{})
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return tmpls, nil
+}
+
+// runHook runs the command of tmpls, expanded with data, in the current
+// directory, with GOBB_BINARY, GOBB_GOOS and GOBB_GOARCH set in its
+// environment. Its output is printed as it runs, and returned in the result.
+// The error is only about running the command: a non-zero exit code is in the
+// result.
+func runHook(tmpls []*template.Template, data hookContext) (*hookResult, error) {
+	res := &hookResult{Command: make([]string, len(tmpls))}
+	for i, t := range tmpls {
+		var b strings.Builder
+		err := t.Execute(&b, data)
+		if err != nil {
+			return nil, err
+		}
+		res.Command[i] = b.String()
+	}
+
+	fmt.Fprintln(logOut, "Running", strings.Join(res.Command, " "))
+	cmd := exec.Command(res.Command[0], res.Command[1:]...)
+	cmd.Env = append(os.Environ(),
+		"GOBB_BINARY="+data.Binary,
+		"GOBB_GOOS="+data.GOOS,
+		"GOBB_GOARCH="+data.GOARCH,
+	)
+	var out bytes.Buffer
+	cmd.Stdout = io.MultiWriter(logOut, &out)
+	cmd.Stderr = io.MultiWriter(os.Stderr, &out)
+	err := cmd.Run()
+	res.Output = out.String()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		res.ExitCode = exitErr.ExitCode()
+		return res, nil
+	}
+	return res, err
+}
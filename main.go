@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"flag"
 	"fmt"
 	"go/ast"
@@ -9,34 +10,133 @@ import (
 	"go/format"
 	"go/parser"
 	"go/token"
+	"go/types"
 	"io"
-	"log"
+	"io/fs"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"text/template"
-
-	"golang.org/x/tools/go/ast/astutil"
+	"time"
 )
 
 var (
 	pathFlag         = flag.String("p", "", "Path to a folder that contains the benchmark code (can be in any sub folder).")
-	nameFlag         = flag.String("n", "", "Regexp that matches the name of the Benchmark* function. Needs to match exactly one function.")
+	nameFlag         = flag.String("n", "", "Regexp that matches the name of the Benchmark* function. Needs to match exactly one function. Slashes separate the patterns of the sub-benchmarks to run, as with go test -bench.")
 	noSrcCleanupFlag = flag.Bool("no-src-cleanup", false, "If true, do not clean up the temporary source directory.")
-	binaryPathFlag   = flag.String("o", "", "Path of the resulting binary.")
+	binaryPathFlag   = flag.String("o", "", "Path of the resulting binary. Can contain {{.Package}}, the import path of the benchmarked package made safe for file names, {{.GOOS}} and {{.GOARCH}}.")
+	iterationsFlag   = flag.Int("iterations", 1, "Default value of b.N, which the benchmark binary reads from "+iterationsEnv+" when set.")
+	multiFlag        = flag.Bool("multi", false, "If true, allow -n to match several functions and build a single binary that runs the one named by its first argument or "+benchmarkEnv+".")
+	estimateFlag     = flag.Bool("estimate", false, "If true, print a heuristic estimate of the benchmark's per-iteration cost and exit without building.")
+	inputFlag        = flag.String("input", "", "Path of a file the benchmark binary reads its input from, in place of stdin. With -input-var, \"-\" means stdin.")
+	inputVarFlag     = flag.String("input-var", "", "Name of a package-level io.Reader variable of the benchmarked package set to the input before running the benchmark.")
+	printCommandFlag = flag.Bool("print-command", false, "If true, print the go build command line, with its working directory and environment, before running it.")
+	buildVCSFlag     = flag.String("buildvcs", "false", "Value of the -buildvcs flag of go build (true, false or auto).")
+	outputFormatFlag = flag.String("output-format", "text", "Format of the summary printed once the binary is built: text or json. With json, the summary is the only output on stdout, and the other messages go to stderr.")
+	exportFlag       = flag.String("export", "", "Directory to prepare the benchmark module in, and keep. If it already contains a module exported by go-bb, only rebuild it.")
+	noOptimizeFlag   = flag.Bool("no-optimize", false, "If true, disable optimizations and inlining (-gcflags=all=-N -l), to step through the benchmark in a debugger. Profiles of such a binary are not representative.")
+	latencyFlag      = flag.Bool("latency", false, "If true, record the duration of each iteration of the benchmark loop, and print percentiles at the end of the run.")
+	goosFlag         = flag.String("goos", "", "Operating system to build the binary for (GOOS). Defaults to the one of the go command.")
+	goarchFlag       = flag.String("goarch", "", "Architecture to build the binary for (GOARCH), for example wasm with -goos=js or -goos=wasip1. Defaults to the one of the go command.")
+	perfMapFlag      = flag.Bool("perf-map", false, "If true, also write the function symbols of the binary to BINARY.map, in the format of perf map files.")
+	cleanFlag        = flag.Bool("clean", false, "If true, remove the go-bb-* temporary directories left by previous runs and the go-bb cache, and exit.")
+	stripHintsFlag   = flag.Bool("strip-runtime-hints", false, "If true, remove the calls to runtime.GC and runtime.Gosched from the benchmark functions.")
+	mergedProfFlag   = flag.String("merged-profile", "", "With -multi, run each benchmark of the binary once built with CPU profiling, and write their merged profile to this file.")
+	inlineStubsFlag  = flag.Bool("inline-stubs", false, "If true, keep the calls of the methods of b, which is bound to a local type standing in for testing.B, instead of removing them.")
+	reportFlag       = flag.Bool("report", false, "If true, the benchmark binary prints the allocations, GC cycles and peak heap size of the run at the end.")
+	goexperimentFlag = flag.String("goexperiment", "", "Comma-separated list of toolchain experiments to build the binary with (GOEXPERIMENT), for example greenteagc.")
+	stripHelpersFlag = flag.Bool("strip-benchmem-helpers", false, "If true, remove the calls of the bookkeeping methods of b (ReportAllocs, ReportMetric, ResetTimer, SetBytes, StartTimer, StopTimer), even with -inline-stubs.")
+	offlineFlag      = flag.Bool("offline", false, "If true, never access the network: dependencies are looked up in the module cache only, where they must already be.")
+	pieFlag          = flag.Bool("pie", false, "If true, build a position-independent executable (-buildmode=pie).")
+	buildInfoFlag    = flag.Bool("show-buildinfo", false, "If true, print the module versions and build settings embedded in the binary, like go version -m.")
+	keepLogsFlag     = flag.Bool("keep-logs", false, "If true, print the arguments of the calls of b.Log and b.Logf to stderr, instead of removing them. Beware that logging from the benchmark loop floods the output and distorts profiles.")
+	sandboxFlag      = flag.Bool("sandbox", false, "If true, build, and run for -merged-profile, in a minimal environment without network access, cgo nor the user's go settings and caches, to build untrusted code.")
+	profileDirFlag   = flag.String("profile-dir", "", "Directory the benchmark binary writes a CPU profile (cpu.pprof) and a heap profile (mem.pprof) of each run to.")
+	perRunFlag       = flag.Bool("profile-per-run", false, "With -profile-dir, write the profiles of each run to their own subdirectory, named by "+runIDEnv+" or else by the time the run starts.")
+	compareFlag      = flag.String("compare-binary", "", "Build flags of a second build, for example -gcflags=-B, whose disassembly of the benchmark functions is diffed against the one of the binary.")
+	foldedFlag       = flag.String("folded", "", "Run the benchmarks of the binary once built with CPU profiling, and write the profile to this file in the folded stacks format of flamegraph tools.")
+	emitFuncFlag     = flag.String("emit-func", "", "Also write the rewritten benchmark functions, renamed RunX and taking the number of iterations as parameter, to this file, to embed them in another program.")
+	matrixFlag       = flag.String("matrix", "", "Comma-separated list of GOOS/GOARCH targets to build the binary for, one after the other, for example linux/amd64,linux/arm64. The -o template defaults to "+matrixOutput+".")
+	quietGoFlag      = flag.Bool("quiet-go", false, "If true, do not print the output of the go commands that succeed. Their errors are still printed.")
+	optReportFlag    = flag.Bool("optreport", false, "If true, print the inlining and escape analysis decisions of the compiler (-gcflags=-m) about the benchmark functions and the functions of the package they call.")
+	timerLabelsFlag  = flag.Bool("timer-labels", false, "If true, replace the calls of b.ResetTimer, b.StartTimer and b.StopTimer by hooks labelling the CPU profile samples gobb=setup, gobb=timed or gobb=stopped. The binary still runs the whole benchmark, setup included: only go tool pprof -tagfocus=gobb=timed leaves out what go test does not measure. Without it, the timer calls are removed and nothing tells the setup apart.")
+	symbolFlag       = flag.String("symbol", "", "Exported name to rename the benchmark function to in the copied package, for example Benchmark, so that its symbol in the binary ends with bborig.NAME whatever the benchmark. Cannot be used with -multi.")
+	listDepsFlag     = flag.Bool("list-deps", false, "If true, print the files go-bb copies for the benchmark, and the packages it imports that are not copied, then exit without building.")
+	bundleFlag       = flag.String("bundle", "", "Write a zip archive of the prepared module, with the command line, to this file, to attach to a bug report. It is written too when go-bb fails once the module is prepared, or while preparing it.")
+	bundleProfFlag   = flag.Bool("bundle-profiles", false, "With -bundle, also add the profiles written by -merged-profile and -folded to the archive.")
+	benchTimeoutFlag = flag.Duration("benchmark-timeout", 0, "Maximum duration of each run of the benchmarks by -merged-profile and -folded, for example 1m. A run lasting longer is interrupted, so that it writes its CPU profile so far, and go-bb fails. No limit if 0.")
+	parallelismFlag  = flag.Int("parallelism", 1, "Default number of goroutines per GOMAXPROCS of b.RunParallel, which b.SetParallelism overrides.")
+	localModuleFlag  = flag.Bool("local-module", false, "If true, build against the other packages of the benchmarked module as they are on disk, through a replace directive, and name the temporary module after it, so that the benchmarked package can import its internal packages. Implied when it imports some.")
+	strictFlag       = flag.Bool("strict", false, "If true, fail instead of rewriting the calls of the methods of b whose rewrite changes what the benchmark does (Chdir, Cleanup, Elapsed, Setenv, TempDir), which -inline-stubs keeps. Other unsupported uses of b always fail.")
+	afterBuildFlag   = flag.String("after-build", "", "Command to run once the binary is built, for example to sign or upload it. Its arguments can contain {{.Binary}}, the absolute path of the binary, {{.GOOS}} and {{.GOARCH}}, which are also in its environment as GOBB_BINARY, GOBB_GOOS and GOBB_GOARCH. go-bb fails if it does.")
+	progressFlag     = flag.String("progress", "", "Write the start and end of each phase (discover, copy, rewrite, generate, init, tidy, vet, build, ...) as JSON lines to stdout, stderr or this file, for tools showing the progress of go-bb.")
+	vetFlag          = flag.Bool("vet", false, "If true, run go vet on the prepared module before building it, and fail if it reports anything.")
+	stampFlags       stringsFlag
+	setFlagFlags     stringsFlag
 )
 
+// logOut is where go-bb tells what it does, and warns: stdout, or stderr with
+// -output-format json, which leaves stdout to the summary.
+var logOut io.Writer = os.Stdout
+
+func init() {
+	flag.Var(&stampFlags, "X", "Set the string variable importpath.name=value at link time (go build -ldflags -X). Can be repeated.")
+	flag.Var(&setFlagFlags, "set-flag", "Set the flag registered as name, or else the package-level variable name, of the benchmarked package to value (name=value) before running the benchmark. Can be repeated.")
+}
+
+// stringsFlag is a flag.Value collecting the values of a repeated flag.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// cleanups are run in reverse order when go-bb exits, through die or at the
+// end of main: a deferred call would not run on os.Exit.
+var cleanups []func()
+
+// atExit registers f to run when go-bb exits.
+func atExit(f func()) {
+	cleanups = append(cleanups, f)
+}
+
+func runCleanups() {
+	for i := len(cleanups) - 1; i >= 0; i-- {
+		cleanups[i]()
+	}
+	cleanups = nil
+}
+
 func die(f string, args ...interface{}) {
+	failPhase(fmt.Sprintf(f, args...))
 	fmt.Fprintf(os.Stderr, f+"\n", args...)
+	if *bundleFlag != "" && bundleSource != "" {
+		err := writeBundle(*bundleFlag, bundleSource, fmt.Sprintf(f, args...), bundleOverlay)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Could not write bundle:", err)
+		} else {
+			fmt.Fprintln(os.Stderr, "Bundle of the prepared module at", *bundleFlag)
+		}
+	}
+	runCleanups()
 	os.Exit(1)
 }
 
 func dieUsage(f string, args ...interface{}) {
+	failPhase(fmt.Sprintf(f, args...))
 	fmt.Fprintf(os.Stderr, f+"\n", args...)
 	flag.Usage()
+	runCleanups()
 	os.Exit(1)
 }
 
@@ -47,25 +147,714 @@ func main() {
 	}
 
 	flag.Parse()
+	defer runCleanups()
+
+	if *cleanFlag {
+		err = clean()
+		if err != nil {
+			die("Could not clean: %s", err)
+		}
+		return
+	}
+
+	exportDir := *exportFlag
+	if exportDir != "" && !path.IsAbs(exportDir) {
+		exportDir = path.Join(cwd, exportDir)
+	}
+
+	var mod preparedModule
+	reuse := false
+	if exportDir != "" {
+		mod, reuse, err = readPreparedModule(exportDir)
+		if err != nil {
+			die("Could not read exported module: %s", err)
+		}
+	}
 
-	if *pathFlag == "" {
+	if !reuse && *pathFlag == "" {
 		dieUsage("Missing -p flag.")
 	}
 
-	if *nameFlag == "" {
+	if !reuse && *nameFlag == "" {
 		dieUsage("Missing -n flag.")
 	}
 
+	if *iterationsFlag < 1 {
+		dieUsage("-iterations must be at least 1.")
+	}
+
+	if *parallelismFlag < 1 {
+		dieUsage("-parallelism must be at least 1.")
+	}
+
+	switch *outputFormatFlag {
+	case "text":
+	case "json":
+		if *progressFlag == "stdout" {
+			dieUsage("-progress cannot write to stdout with -output-format json, which writes the summary there.")
+		}
+		logOut = os.Stderr
+	default:
+		dieUsage("-output-format must be text or json.")
+	}
+
+	switch *buildVCSFlag {
+	case "true", "false", "auto":
+	default:
+		dieUsage("-buildvcs must be true, false or auto.")
+	}
+
+	for _, x := range stampFlags {
+		if _, _, err := splitStampedVar(x); err != nil {
+			dieUsage("Invalid -X %s: %s", x, err)
+		}
+	}
+
+	for _, x := range setFlagFlags {
+		if _, err := splitSetFlag(x); err != nil {
+			dieUsage("Invalid -set-flag %s: %s", x, err)
+		}
+	}
+
+	if *emitFuncFlag != "" && (*latencyFlag || *inlineStubsFlag || *keepLogsFlag || *timerLabelsFlag) {
+		dieUsage("-emit-func cannot be used with -latency, -inline-stubs, -keep-logs nor -timer-labels, whose rewrites depend on code generated in the copied package.")
+	}
+	if *timerLabelsFlag && *stripHelpersFlag {
+		dieUsage("-timer-labels cannot be used with -strip-benchmem-helpers, which removes the calls of the timer methods.")
+	}
+
+	var compareArgs []string
+	if *compareFlag != "" {
+		var err error
+		compareArgs, err = splitFlags(*compareFlag)
+		if err != nil {
+			dieUsage("Invalid -compare-binary: %s", err)
+		}
+	}
+
+	if *symbolFlag != "" {
+		if *multiFlag {
+			dieUsage("-symbol cannot be used with -multi, whose benchmarks cannot all have the same name.")
+		}
+		if !token.IsIdentifier(*symbolFlag) || !ast.IsExported(*symbolFlag) {
+			dieUsage("Invalid -symbol %q: expected an exported identifier", *symbolFlag)
+		}
+	}
+
+	if *bundleProfFlag && *bundleFlag == "" {
+		dieUsage("-bundle-profiles requires -bundle.")
+	}
+
+	var afterBuild []*template.Template
+	if *afterBuildFlag != "" {
+		var err error
+		afterBuild, err = parseHook(*afterBuildFlag)
+		if err != nil {
+			dieUsage("Invalid -after-build: %s", err)
+		}
+	}
+
+	if *progressFlag != "" {
+		err := openProgress(*progressFlag)
+		if err != nil {
+			dieUsage("Invalid -progress: %s", err)
+		}
+	}
+
+	if *matrixFlag != "" {
+		targets, err := parseMatrix(*matrixFlag)
+		if err != nil {
+			dieUsage("Invalid -matrix: %s", err)
+		}
+		if *goosFlag != "" || *goarchFlag != "" {
+			dieUsage("-matrix cannot be used with -goos nor -goarch.")
+		}
+		if *mergedProfFlag != "" || *foldedFlag != "" || *compareFlag != "" {
+			dieUsage("-matrix cannot be used with -merged-profile, -folded nor -compare-binary, which run or disassemble the binary.")
+		}
+		output := *binaryPathFlag
+		if output == "" {
+			output = matrixOutput
+		}
+		tmpl, err := template.New("o").Option("missingkey=error").Parse(output)
+		if err == nil {
+			err = checkMatrixOutput(tmpl, targets)
+		}
+		if err != nil {
+			dieUsage("Invalid -o: %s", err)
+		}
+		results, err := runMatrix(targets, output)
+		if err != nil {
+			die("Could not build the matrix: %s", err)
+		}
+		err = writeMatrix(os.Stdout, results, *outputFormatFlag)
+		if err != nil {
+			die("Could not print summary: %s", err)
+		}
+		failed := 0
+		for _, r := range results {
+			if r.Error != "" {
+				failed++
+			}
+		}
+		if failed > 0 {
+			die("%d of %d targets failed", failed, len(results))
+		}
+		return
+	}
+
+	if *sandboxFlag {
+		sandboxDir, err := enterSandbox()
+		if err != nil {
+			die("Could not set up the sandbox: %s", err)
+		}
+		fmt.Fprintln(logOut, "Sandbox at", sandboxDir)
+		atExit(func() {
+			err := os.RemoveAll(sandboxDir)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Warning: could not remove the sandbox:", err)
+			}
+		})
+	}
+
+	// Set in the environment rather than passed to the build command, so
+	// that all the go commands, and -print-command, agree on the target.
+	if *goosFlag != "" {
+		os.Setenv("GOOS", *goosFlag)
+		build.Default.GOOS = *goosFlag
+	}
+	if *goarchFlag != "" {
+		os.Setenv("GOARCH", *goarchFlag)
+		build.Default.GOARCH = *goarchFlag
+	}
+
+	if *offlineFlag {
+		// Tidy may still need to look modules up, such as the module of
+		// the benchmarked package itself: the module cache serves as proxy,
+		// which GOPROXY=off would not allow. Its content was verified
+		// when it was downloaded, and GOSUMDB would be queried for the
+		// checksums missing from the new go.sum.
+		os.Setenv("GOPROXY", "file://"+filepath.ToSlash(path.Join(goEnv("GOMODCACHE"), "cache", "download")))
+		os.Setenv("GOSUMDB", "off")
+		os.Setenv("GOTOOLCHAIN", "local")
+	}
+
+	// The go command disables cgo when cross-compiling, and applies the
+	// settings of go env -w, which build.Default knows nothing about.
+	// Discovery must select the same files as the build.
+	build.Default.CgoEnabled = goEnv("CGO_ENABLED") == "1"
+
+	if *goexperimentFlag != "" {
+		os.Setenv("GOEXPERIMENT", *goexperimentFlag)
+		// The go command refuses to run at all with an unknown
+		// experiment, so there is no point in going further.
+		if err := checkGoExperiment(); err != nil {
+			dieUsage("Invalid -goexperiment: %s", err)
+		}
+	}
+
+	outputTmpl, err := template.New("o").Option("missingkey=error").Parse(*binaryPathFlag)
+	if err == nil {
+		// Catch unknown fields before preparing anything.
+		err = outputTmpl.Execute(io.Discard, outputContext{})
+	}
+	if err != nil {
+		dieUsage("Invalid -o: %s", err)
+	}
+
+	if reuse {
+		fmt.Fprintln(logOut, "Reusing exported module", exportDir)
+		if *pathFlag != "" {
+			pkg, err := build.Default.Import(*pathFlag, cwd, build.FindOnly)
+			if err != nil || pkg.Dir != mod.OrigDir {
+				die("-p must name the package the module was exported from (%s), since it is not copied again", mod.OrigDir)
+			}
+		}
+		if *nameFlag != "" && *nameFlag != mod.Pattern {
+			die("-n must match the value used when exporting the module (%q), since the benchmarks are not selected again", mod.Pattern)
+		}
+		// The other flags are applied again to the generated main.go and
+		// hooks.
+		for _, f := range []struct {
+			name      string
+			now, then interface{}
+		}{
+			{"multi", *multiFlag, mod.Multi},
+			{"latency", *latencyFlag, mod.Latency},
+			{"inline-stubs", *inlineStubsFlag, mod.InlineStubs},
+			{"keep-logs", *keepLogsFlag, mod.KeepLogs},
+			{"timer-labels", *timerLabelsFlag, mod.TimerLabels},
+			{"strip-runtime-hints", *stripHintsFlag, mod.StripRuntimeHints},
+			{"strip-benchmem-helpers", *stripHelpersFlag, mod.StripBenchmemHelpers},
+			{"strict", *strictFlag, mod.Strict},
+			{"symbol", *symbolFlag, mod.Functions[0].Symbol},
+		} {
+			if f.now != f.then {
+				die("-%s must match the value used when exporting the module (%#v), since it changes the rewrite", f.name, f.then)
+			}
+		}
+		bundleSource = mod.Dir
+	} else {
+		mod = prepareModule(cwd, exportDir)
+	}
+
 	binaryPath := path.Join(cwd, "benchmark.binary")
+	if isWasm() {
+		binaryPath = path.Join(cwd, "benchmark.wasm")
+	}
 	if *binaryPathFlag != "" {
-		binaryPath = *binaryPathFlag
+		binaryPath, err = expandOutputPath(outputTmpl, mod)
+		if err != nil {
+			die("Could not expand -o: %s", err)
+		}
 		if !path.IsAbs(binaryPath) {
 			binaryPath = path.Join(cwd, binaryPath)
 		}
+		err = os.MkdirAll(path.Dir(binaryPath), 0755)
+		if err != nil {
+			die("Could not create the directory of %s: %s", binaryPath, err)
+		}
 	}
 
+	if *emitFuncFlag != "" {
+		emitPath := *emitFuncFlag
+		if !path.IsAbs(emitPath) {
+			emitPath = path.Join(cwd, emitPath)
+		}
+		err = emitFuncs(mod, emitPath)
+		if err != nil {
+			die("Could not write the benchmark functions: %s", err)
+		}
+		fmt.Fprintln(logOut, "Wrote benchmark functions to", emitPath)
+	}
+
+	data := templateContext{
+		OrigImport:    mod.bborigImport(),
+		XTestImport:   mod.bborigImport() + "/" + xtestDir,
+		Multi:         mod.Multi,
+		BenchmarkEnv:  benchmarkEnv,
+		IterationsEnv: iterationsEnv,
+		IterationsVar: iterationsVar,
+		IterationsArg: 1,
+		Iterations:    *iterationsFlag,
+		Latency:       *latencyFlag,
+		Report:        *reportFlag,
+	}
+	if mod.Multi {
+		// After the name of the benchmark.
+		data.IterationsArg = 2
+	}
+	if *mergedProfFlag != "" {
+		if !mod.Multi {
+			dieUsage("-merged-profile requires -multi.")
+		}
+		if isWasm() {
+			dieUsage("-merged-profile cannot run a WebAssembly binary.")
+		}
+		data.CPUProfile = true
+		data.CPUProfileEnv = cpuProfileEnv
+	}
+	if *foldedFlag != "" {
+		if isWasm() {
+			dieUsage("-folded cannot run a WebAssembly binary.")
+		}
+		data.CPUProfile = true
+		data.CPUProfileEnv = cpuProfileEnv
+	}
+	if *compareFlag != "" && isWasm() {
+		dieUsage("-compare-binary cannot disassemble a WebAssembly binary.")
+	}
+	if *perRunFlag && *profileDirFlag == "" {
+		dieUsage("-profile-per-run requires -profile-dir.")
+	}
+	if *profileDirFlag != "" {
+		data.ProfileDir = *profileDirFlag
+		if !path.IsAbs(data.ProfileDir) {
+			data.ProfileDir = path.Join(cwd, data.ProfileDir)
+		}
+		data.ProfilePerRun = *perRunFlag
+		data.RunIDEnv = runIDEnv
+	}
+
+	for i, name := range mod.functionNames() {
+		f := mod.Functions[i]
+		tf := templateFunc{Pkg: "orig", Name: f.symbol(), Key: name}
+		if f.XTest {
+			tf.Pkg = "xtest"
+		}
+		data.Funcs = append(data.Funcs, tf)
+	}
+
+	hooks := hooksContext{
+		Package:       mod.Package,
+		IterationsVar: iterationsVar,
+		Iterations:    *iterationsFlag,
+		Parallelism:   *parallelismFlag,
+		InputVar:      *inputVarFlag,
+		Latency:       *latencyFlag,
+		KeepLogs:      mod.KeepLogs,
+		TimerLabels:   mod.TimerLabels,
+	}
+	if mod.InlineStubs {
+		hooks.StubType = stubType
+	}
+
+	if len(setFlagFlags) > 0 {
+		vars, err := packageVars(path.Join(mod.Dir, "bborig"))
+		if err != nil {
+			die("Could not list the variables of the copied package: %s", err)
+		}
+		for _, x := range setFlagFlags {
+			sf, _ := splitSetFlag(x)
+			sf.Var = vars[sf.Name]
+			hooks.SetFlags = append(hooks.SetFlags, sf)
+		}
+		data.SetFlags = true
+	}
+
+	if *inputFlag != "" && *inputFlag != "-" {
+		data.Input = *inputFlag
+		if !path.IsAbs(data.Input) {
+			data.Input = path.Join(cwd, data.Input)
+		}
+	}
+	if hooks.InputVar != "" {
+		data.InputVar = true
+		if data.Input == "" {
+			data.Input = "-"
+		}
+	}
+
+	startPhase("generate")
+	// A reused module is left as exported: the files generated from the
+	// current flags replace the ones of the module through -overlay.
+	genDir := mod.Dir
+	if reuse {
+		genDir, err = makeTempDir()
+		if err != nil {
+			die("Could not create the overlay directory: %s", err)
+		}
+		if !*noSrcCleanupFlag {
+			atExit(func() { os.RemoveAll(genDir) })
+		}
+		err = os.Mkdir(path.Join(genDir, "bborig"), 0700)
+		if err != nil {
+			die("Could not create the overlay directory: %s", err)
+		}
+		mod.Overlay = map[string]string{}
+		for _, name := range []string{path.Join("bborig", hooksFileName), "main.go"} {
+			mod.Overlay[name] = path.Join(genDir, name)
+		}
+	}
+
+	hooksFilePath := path.Join(genDir, "bborig", hooksFileName)
+	err = renderHooksToFile(hooks, hooksFilePath)
+	if err != nil {
+		die("Could not generate %s: %s", hooksFilePath, err)
+	}
+
+	mainFilePath := path.Join(genDir, "main.go")
+	err = renderMainToFile(data, mainFilePath)
+	if err != nil {
+		die("Could not generate %s: %s", mainFilePath, err)
+	}
+
+	var overlayArgs []string
+	if mod.Overlay != nil {
+		overlayFile := path.Join(genDir, "overlay.json")
+		err = writeOverlay(mod, overlayFile)
+		if err != nil {
+			die("Could not write %s: %s", overlayFile, err)
+		}
+		overlayArgs = []string{"-overlay=" + overlayFile}
+		bundleOverlay = mod.Overlay
+	}
+
+	if !reuse {
+		startPhase("init")
+		fmt.Fprintln(logOut, "Initializing module", mod.Module)
+		err = runGo(mod.Dir, "mod", "init", mod.Module)
+		if err != nil {
+			die("Failed to init module: %s", err)
+		}
+		if goMod := origGoMod(mod.OrigDir); goMod != "" {
+			fmt.Fprintln(logOut, "Copying the requirements of", goMod)
+			err = copyRequirements(goMod, mod.Dir)
+			if err != nil {
+				die("Could not copy the requirements of %s: %s", goMod, err)
+			}
+		}
+		if mod.LocalModule != "" {
+			fmt.Fprintln(logOut, "Replacing", mod.LocalModule, "by", mod.LocalModuleDir)
+			err = requireLocalModule(mod.Dir, mod.LocalModule, mod.LocalModuleDir)
+			if err != nil {
+				die("Could not require %s: %s", mod.LocalModule, err)
+			}
+		}
+
+		startPhase("tidy")
+		fmt.Fprintln(logOut, "Running tidy")
+		err = runGo(mod.Dir, "mod", "tidy")
+		if err != nil {
+			if hint := localModuleHint(err, mod.OrigDir); mod.LocalModule == "" && hint != "" {
+				die("Failed to tidy module: %s\n%s", err, hint)
+			}
+			if *offlineFlag {
+				die("Failed to tidy module: %s\nWith -offline, the dependencies must be in the module cache: run go mod download in the benchmarked module first.", err)
+			}
+			die("Failed to tidy module: %s", err)
+		}
+
+		if exportDir != "" {
+			err = writePreparedModule(mod)
+			if err != nil {
+				die("Could not write %s: %s", preparedModuleFile, err)
+			}
+		}
+	}
+
+	if *vetFlag {
+		startPhase("vet")
+		fmt.Fprintln(logOut, "Running vet")
+		cmd := exec.Command("go", append(append([]string{"vet"}, overlayArgs...), "./...")...)
+		cmd.Dir = mod.Dir
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			fmt.Fprint(logOut, mod.origPositions(string(out)))
+			die("go vet reported issues in the prepared module: %s", err)
+		}
+	}
+
+	buildArgs := append([]string{"build", "-o", binaryPath, "-buildvcs=" + *buildVCSFlag}, overlayArgs...)
+
+	if len(stampFlags) > 0 {
+		ldflags := make([]string, 0, 2*len(stampFlags))
+		for _, x := range stampFlags {
+			ldflags = append(ldflags, "-X", quoteLdflag(remapStampedVar(x, mod.OrigImportPaths, data.OrigImport)))
+		}
+		buildArgs = append(buildArgs, "-ldflags", strings.Join(ldflags, " "))
+	}
+
+	if *pieFlag {
+		if warning := checkPIE(); warning != "" {
+			fmt.Fprintln(logOut, "Warning:", warning)
+		}
+		buildArgs = append(buildArgs, "-buildmode=pie")
+	}
+
+	if *noOptimizeFlag {
+		fmt.Fprintln(logOut, "Warning: optimizations are disabled, profiles of this binary are not representative")
+		buildArgs = append(buildArgs, "-gcflags=all=-N -l")
+	}
+
+	if *printCommandFlag {
+		fmt.Fprintln(logOut, "Build command:")
+		fmt.Fprintln(logOut, "  "+formatGoCommand(mod.Dir, buildArgs))
+	}
+
+	startPhase("build")
+	fmt.Fprintln(logOut, "Compiling")
+	buildStart := time.Now()
+	err = runGo(mod.Dir, buildArgs...)
+	buildTime := time.Since(buildStart)
+	if err != nil {
+		die("Failed to compile benchmark binary: %s", err)
+	}
+
+	if *compareFlag != "" {
+		startPhase("compare")
+		symbols := make([]string, len(mod.Functions))
+		for i, f := range mod.Functions {
+			pkg := mod.bborigImport()
+			if f.XTest {
+				pkg += "/" + xtestDir
+			}
+			symbols[i] = pkg + "." + f.symbol()
+		}
+		err = compareCodegen(mod.Dir, binaryPath, buildArgs, compareArgs, symbols)
+		if err != nil {
+			die("Could not compare the disassembly: %s", err)
+		}
+	}
+
+	sum := summary{
+		Binary:    binaryPath,
+		Functions: mod.functionNames(),
+		BuildTime: buildTime,
+		Rewrites:  mod.Rewrites,
+	}
+	if fi, err := os.Stat(binaryPath); err == nil {
+		sum.Size = fi.Size()
+	}
+	sum.GoExperiment = os.Getenv("GOEXPERIMENT")
+	if *pieFlag {
+		sum.BuildMode = "pie"
+	}
+	if *buildInfoFlag {
+		sum.BuildInfo, err = readBuildInfo(binaryPath)
+		if err != nil {
+			die("Could not read the build information of %s: %s", binaryPath, err)
+		}
+	}
+	if warning := checkSymbols(binaryPath); warning != "" {
+		fmt.Fprintln(logOut, "Warning:", warning)
+	}
+	if *optReportFlag {
+		startPhase("optreport")
+		gcflags := ""
+		if *noOptimizeFlag {
+			gcflags = "-N -l"
+		}
+		sum.OptReport, err = optReport(mod, buildArgs, gcflags)
+		if err != nil {
+			die("Could not build the optimization report: %s", err)
+		}
+	}
+	if *perfMapFlag {
+		sum.PerfMap = binaryPath + ".map"
+		err = writePerfMap(binaryPath, sum.PerfMap)
+		if err != nil {
+			die("Could not write perf map: %s", err)
+		}
+	}
+	if isWasm() {
+		fmt.Fprintln(logOut, "Note: a WebAssembly binary needs a host to run: a browser or Node.js for js/wasm, a WASI runtime such as wasmtime for wasip1")
+		if build.Default.GOOS == "js" {
+			sum.WasmExec = wasmExecPath()
+		}
+	}
+	runDir := ""
+	if *sandboxFlag {
+		// Like go test, next to the copied testdata.
+		runDir = path.Join(mod.Dir, "bborig")
+	}
+	if *mergedProfFlag != "" || *foldedFlag != "" {
+		startPhase("profile")
+	}
+	if *mergedProfFlag != "" {
+		sum.MergedProfile = *mergedProfFlag
+		if !path.IsAbs(sum.MergedProfile) {
+			sum.MergedProfile = path.Join(cwd, sum.MergedProfile)
+		}
+		err = mergeProfiles(binaryPath, runDir, sum.Functions, sum.MergedProfile, *benchTimeoutFlag)
+		if err != nil {
+			die("Could not write merged profile: %s", err)
+		}
+	}
+	if *foldedFlag != "" {
+		sum.Folded = *foldedFlag
+		if !path.IsAbs(sum.Folded) {
+			sum.Folded = path.Join(cwd, sum.Folded)
+		}
+		err = writeFoldedProfile(mod, binaryPath, runDir, sum, *benchTimeoutFlag)
+		if err != nil {
+			die("Could not write folded stacks: %s", err)
+		}
+	}
+	if afterBuild != nil {
+		startPhase("after-build")
+		sum.AfterBuild, err = runHook(afterBuild, hookContext{
+			Binary: binaryPath,
+			GOOS:   build.Default.GOOS,
+			GOARCH: build.Default.GOARCH,
+		})
+		if err != nil {
+			die("Could not run the -after-build command: %s", err)
+		}
+		if sum.AfterBuild.ExitCode != 0 {
+			die("The -after-build command failed with exit code %d", sum.AfterBuild.ExitCode)
+		}
+	}
+	if *bundleFlag != "" {
+		startPhase("bundle")
+		extra := map[string]string{}
+		if *bundleProfFlag {
+			for _, p := range []string{sum.MergedProfile, sum.Folded} {
+				if p != "" {
+					extra[path.Join("profiles", path.Base(p))] = p
+				}
+			}
+		}
+		sum.Bundle = *bundleFlag
+		if !path.IsAbs(sum.Bundle) {
+			sum.Bundle = path.Join(cwd, sum.Bundle)
+		}
+		for name, p := range mod.Overlay {
+			extra[name] = p
+		}
+		err = writeBundle(sum.Bundle, mod.Dir, "", extra)
+		if err != nil {
+			bundleSource = ""
+			die("Could not write bundle: %s", err)
+		}
+	}
+	endPhase()
+	err = sum.write(os.Stdout, *outputFormatFlag)
+	if err != nil {
+		die("Could not write summary: %s", err)
+	}
+}
+
+// outputContext is the data -o is expanded with.
+type outputContext struct {
+	// Import path of the benchmarked package, made safe to use as a file
+	// name.
+	Package string
+	GOOS    string
+	GOARCH  string
+}
+
+// expandOutputPath executes the -o template for the benchmarks of mod.
+func expandOutputPath(tmpl *template.Template, mod preparedModule) (string, error) {
+	data := outputContext{
+		Package: sanitizeFileName(mod.importPath()),
+		GOOS:    build.Default.GOOS,
+		GOARCH:  build.Default.GOARCH,
+	}
+	var b strings.Builder
+	err := tmpl.Execute(&b, data)
+	return b.String(), err
+}
+
+// sanitizeFileName replaces the characters of s that are unsafe in file
+// names, including the path separator, by underscores.
+func sanitizeFileName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// splitBenchmarkName splits the value of -n at its slashes, like go test
+// -bench does, into the pattern of the benchmark functions and the ones of
+// their sub-benchmarks.
+func splitBenchmarkName(s string) (string, []string) {
+	parts := strings.Split(s, "/")
+	return parts[0], parts[1:]
+}
+
+// prepareModule finds the benchmark functions selected by the flags, and
+// creates a module in which they are rewritten so that they can be called
+// from a generated main. The module is created in exportDir if not empty, or
+// in a temporary directory otherwise. The generated files (main.go and the
+// hooks of the copied package) are not written, and the module is not
+// initialized yet.
+func prepareModule(cwd, exportDir string) preparedModule {
+	startPhase("discover")
 	module := *pathFlag
-	nameRegex := regexp.MustCompile(".*" + *nameFlag + ".*")
+	funcPattern, subPatterns := splitBenchmarkName(*nameFlag)
+	nameRegex := regexp.MustCompile(".*" + funcPattern + ".*")
+	var subRegexps []*regexp.Regexp
+	for _, p := range subPatterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			dieUsage("Invalid sub-benchmark pattern %q of -n: %s", p, err)
+		}
+		subRegexps = append(subRegexps, re)
+	}
 
 	buildCtx := build.Default
 
@@ -74,32 +863,79 @@ func main() {
 		die("Could not import provided module '%s': %s", module, err)
 	}
 
+	if isWasm() {
+		warnWasmImports(pkg)
+	}
+
 	foundBenchFuncs := findBenchmarkFuncs(pkg, nameRegex)
 	if len(foundBenchFuncs) == 0 {
 		die("Could not find any benchmark function in %s matching %s", module, nameRegex)
 	}
 
 	for _, x := range foundBenchFuncs {
-		fmt.Printf("Found matching function: %s (%s)\n", x.name, x.file)
+		if x.xtest {
+			fmt.Fprintf(logOut, "Found matching function: %s (%s, package %s_test)\n", x.name, x.file, pkg.Name)
+		} else {
+			fmt.Fprintf(logOut, "Found matching function: %s (%s)\n", x.name, x.file)
+		}
 	}
 
-	if len(foundBenchFuncs) > 1 {
+	if len(foundBenchFuncs) > 1 && !*multiFlag {
 		die("There should be only one matching function in %s for %s, but found %d", module, nameRegex, len(foundBenchFuncs))
 	}
 
-	benchFuncLoc := foundBenchFuncs[0]
-
-	tmpDir, err := os.MkdirTemp("", "go-bb-*")
-	if err != nil {
-		die("Could not create temporary source directory: %s", err)
+	if *estimateFlag {
+		for _, loc := range foundBenchFuncs {
+			est, err := estimateBenchFunc(pkg.Dir, loc)
+			if err != nil {
+				die("Could not estimate benchmark function: %s", err)
+			}
+			est.print(os.Stdout, loc.name)
+		}
+		endPhase()
+		runCleanups()
+		os.Exit(0)
 	}
 
-	if !*noSrcCleanupFlag {
-		defer os.Remove(tmpDir)
+	if *listDepsFlag {
+		r, err := listDeps(pkg)
+		if err != nil {
+			die("Could not list dependencies: %s", err)
+		}
+		err = r.write(os.Stdout, *outputFormatFlag)
+		if err != nil {
+			die("Could not write dependencies: %s", err)
+		}
+		endPhase()
+		runCleanups()
+		os.Exit(0)
 	}
 
-	fmt.Println("Temporary source directory:", tmpDir)
+	var tmpDir string
+	if exportDir != "" {
+		tmpDir = exportDir
+		if files, err := os.ReadDir(tmpDir); err == nil && len(files) > 0 {
+			die("Export directory %s is not empty and does not contain a module exported by go-bb", tmpDir)
+		}
+		err = os.MkdirAll(tmpDir, 0700)
+		if err != nil {
+			die("Could not create export directory: %s", err)
+		}
+		fmt.Fprintln(logOut, "Export directory:", tmpDir)
+	} else {
+		tmpDir, err = makeTempDir()
+		if err != nil {
+			die("Could not create temporary source directory: %s", err)
+		}
+		if !*noSrcCleanupFlag {
+			atExit(func() { os.RemoveAll(tmpDir) })
+		}
 
+		fmt.Fprintln(logOut, "Temporary source directory:", tmpDir)
+	}
+
+	startPhase("copy")
+	bundleSource = tmpDir
 	bborigPath := path.Join(tmpDir, "bborig")
 
 	err = os.Mkdir(bborigPath, 0700)
@@ -112,6 +948,85 @@ func main() {
 		die("Failed to copy original sources from '%s' to '%s': %s", pkg.Dir, bborigPath, err)
 	}
 
+	// A main package cannot be imported by the generated main.
+	pkgName := pkg.Name
+	if pkgName == "main" {
+		pkgName = "bborig"
+		fmt.Fprintln(logOut, "Renaming package main to", pkgName)
+		err = renamePackage(bborigPath, "main", pkgName)
+		if err != nil {
+			die("Could not rename package main: %s", err)
+		}
+	}
+
+	tmpModuleName := path.Base(tmpDir)
+	if exportDir != "" {
+		tmpModuleName = "go-bb-export"
+	}
+	fullTmpModule := "example.com/" + tmpModuleName
+	var localModule, localModuleDir string
+	useLocalModule := *localModuleFlag
+	if p := internalImport(pkg); p != "" && !useLocalModule && origGoMod(pkg.Dir) != "" {
+		fmt.Fprintf(logOut, "The benchmarked package imports %s, an internal package: building against its module on disk, as with -local-module\n", p)
+		useLocalModule = true
+	}
+	if useLocalModule {
+		// Within the path of the benchmarked module, so that the
+		// copied package may import its internal packages.
+		goMod := origGoMod(pkg.Dir)
+		if goMod == "" {
+			die("Cannot use -local-module: %s is not part of a module", pkg.Dir)
+		}
+		f, err := readGoMod(goMod)
+		if err != nil {
+			die("Could not read %s: %s", goMod, err)
+		}
+		localModule, localModuleDir = f.Module.Path, filepath.Dir(goMod)
+		fullTmpModule = localModule + "/" + tmpModuleName
+	}
+
+	mod := preparedModule{
+		Dir:                  tmpDir,
+		Module:               fullTmpModule,
+		Package:              pkgName,
+		OrigDir:              pkg.Dir,
+		Pattern:              *nameFlag,
+		Multi:                *multiFlag,
+		Latency:              *latencyFlag,
+		InlineStubs:          *inlineStubsFlag,
+		KeepLogs:             *keepLogsFlag,
+		TimerLabels:          *timerLabelsFlag,
+		StripRuntimeHints:    *stripHintsFlag,
+		StripBenchmemHelpers: *stripHelpersFlag,
+		Strict:               *strictFlag,
+		OrigImportPaths:      []string{pkg.ImportPath},
+		LocalModule:          localModule,
+		LocalModuleDir:       localModuleDir,
+	}
+	if build.IsLocalImport(pkg.ImportPath) {
+		if p := resolveImportPath(pkg.Dir); p != "" {
+			mod.OrigImportPaths = append(mod.OrigImportPaths, p)
+		}
+	}
+	for _, loc := range foundBenchFuncs {
+		mod.Functions = append(mod.Functions, preparedFunc{
+			Name:   loc.name,
+			XTest:  loc.xtest,
+			Symbol: *symbolFlag,
+		})
+	}
+
+	// The external test package cannot live in the same directory as the
+	// package it tests, once its files are not test files anymore.
+	xtestPath := path.Join(bborigPath, xtestDir)
+	if len(pkg.XTestGoFiles) > 0 {
+		fmt.Fprintln(logOut, "Moving external test files to", xtestPath)
+		err = moveXTestFiles(bborigPath, xtestPath, pkg.XTestGoFiles, mod.OrigImportPaths, mod.bborigImport())
+		if err != nil {
+			die("Could not move external test files: %s", err)
+		}
+	}
+
 	bborigModulePath, err := filepath.Rel(cwd, bborigPath)
 	if err != nil {
 		die("Could not compute relative path from %s to %s", cwd, bborigPath)
@@ -122,253 +1037,309 @@ func main() {
 	// 	die("Copied module is invalid: %s", err)
 	// }
 
-	fmt.Println("Rewriting benchmark function")
-	err = rewriteBenchFuncInPlace(bborigModulePath, benchFuncLoc)
+	startPhase("rewrite")
+	opts := rewriteOptions{
+		iterationsVar:     iterationsVar,
+		stripRuntimeHints: *stripHintsFlag,
+		stripBookkeeping:  *stripHelpersFlag,
+		keepLogs:          *keepLogsFlag,
+		timerLabels:       *timerLabelsFlag,
+		rename:            *symbolFlag,
+		subBenchmarks:     subRegexps,
+		strict:            *strictFlag,
+		changes:           &mod.Rewrites,
+		origDir:           pkg.Dir,
+	}
+	if *latencyFlag {
+		opts.tickFunc = "GoBBTick"
+	}
+	if *inlineStubsFlag {
+		opts.stubType = stubType
+	}
+	for _, loc := range foundBenchFuncs {
+		fmt.Fprintln(logOut, "Rewriting benchmark function", loc.name)
+		dir := bborigModulePath
+		fileOpts := opts
+		if loc.xtest {
+			// The hooks are declared in the tested package.
+			dir = path.Join(dir, xtestDir)
+			fileOpts.hooksImport = mod.bborigImport()
+			fileOpts.hooksPackage = pkgName
+		}
+		err = rewriteBenchFuncInPlace(dir, loc, fileOpts)
+		if err != nil {
+			die("Could not rewrite benchmark function: %s", err)
+		}
+	}
+	sort.SliceStable(mod.Rewrites, func(i, j int) bool {
+		a, b := mod.Rewrites[i], mod.Rewrites[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		return a.Line < b.Line
+	})
+
+	internalFuncs := map[string]bool{}
+	xtestFuncs := map[string]bool{}
+	for _, loc := range foundBenchFuncs {
+		if loc.xtest {
+			xtestFuncs[loc.name] = true
+		} else {
+			internalFuncs[loc.name] = true
+		}
+	}
+	err = removePackageRefs(bborigModulePath, internalFuncs)
+	if err == nil && len(pkg.XTestGoFiles) > 0 {
+		err = removePackageRefs(xtestPath, xtestFuncs)
+	}
 	if err != nil {
-		die("Could not rewrite benchmark function: %s", err)
+		die("Could not rewrite references to benchmark functions: %s", err)
 	}
 
-	fmt.Println("Renaming test files")
+	fmt.Fprintln(logOut, "Renaming test files")
 	err = renameTestFiles(bborigModulePath)
 	if err != nil {
 		die("Could not rename test files: %s", err)
 	}
-
-	tmpModuleName := path.Base(tmpDir)
-	fullTmpModule := "example.com/" + tmpModuleName
-
-	data := templateContext{
-		OrigImport: fullTmpModule + "/bborig",
-		Func:       benchFuncLoc.name,
+	if len(pkg.XTestGoFiles) > 0 {
+		err = renameTestFiles(xtestPath)
+		if err != nil {
+			die("Could not rename test files: %s", err)
+		}
 	}
 
-	mainFilePath := path.Join(tmpDir, "main.go")
-	renderMainToFile(data, mainFilePath)
-
-	fmt.Println("Initializing module", fullTmpModule)
-	err = runGo(tmpDir, "mod", "init", fullTmpModule)
-	if err != nil {
-		die("Failed to init module: %s", err)
-	}
+	return mod
+}
 
-	fmt.Println("Running tidy")
-	err = runGo(tmpDir, "mod", "tidy")
-	if err != nil {
-		die("Failed to tidy module: %s", err)
+// splitStampedVar splits the argument of -X into the import path of the
+// package declaring the variable, and the rest (name=value).
+func splitStampedVar(x string) (string, string, error) {
+	eq := strings.Index(x, "=")
+	if eq < 0 {
+		return "", "", fmt.Errorf("expected importpath.name=value")
 	}
-
-	fmt.Println("Compiling")
-	err = runGo(tmpDir, "build", "-o", binaryPath)
-	if err != nil {
-		die("Failed to compile benchmark binary: %s", err)
+	dot := strings.LastIndex(x[:eq], ".")
+	if dot <= 0 || dot == eq-1 {
+		return "", "", fmt.Errorf("expected importpath.name=value")
 	}
-
-	fmt.Println("Benchmark binary ready at", binaryPath)
+	return x[:dot], x[dot+1:], nil
 }
 
-func renameTestFiles(p string) error {
-	files, err := os.ReadDir(p)
+// remapStampedVar rewrites the argument of -X so that variables of the
+// benchmarked package, known as origImportPaths, point to its copy at
+// bborigImport instead.
+func remapStampedVar(x string, origImportPaths []string, bborigImport string) string {
+	importPath, rest, err := splitStampedVar(x)
 	if err != nil {
-		return err
+		return x
 	}
-	for _, x := range files {
-		if x.IsDir() || !strings.HasSuffix(x.Name(), "_test.go") {
-			continue
+	for _, p := range origImportPaths {
+		if p != "" && p == importPath {
+			return bborigImport + "." + rest
 		}
+	}
+	return x
+}
 
-		newName := strings.Replace(x.Name(), "_test.go", "_bborig.go", 1)
-		fromFilePath := path.Join(p, x.Name())
-		toFilePath := path.Join(p, newName)
-		err = os.Rename(fromFilePath, toFilePath)
-		if err != nil {
-			return fmt.Errorf("renaming %s to %s: %w", fromFilePath, toFilePath, err)
-		}
+// quoteLdflag quotes a single -ldflags argument if needed. The go command
+// accepts single or double quotes, without escapes.
+func quoteLdflag(s string) string {
+	switch {
+	case strings.Contains(s, "'"):
+		return `"` + s + `"`
+	case strings.ContainsAny(s, " \t\""):
+		return "'" + s + "'"
 	}
-	return nil
+	return s
 }
 
-func runGo(dir string, args ...string) error {
-	cmd := exec.Command("go", args...)
+// resolveImportPath returns the import path of the package in dir, as
+// reported by the go command, or "" if it cannot be determined.
+func resolveImportPath(dir string) string {
+	cmd := exec.Command("go", "list", "-f", "{{.ImportPath}}")
 	cmd.Dir = dir
 	out, err := cmd.Output()
 	if err != nil {
-		return err
+		return ""
 	}
-	fmt.Print(string(out))
-	return nil
+	return strings.TrimSpace(string(out))
 }
 
-func renderMainToFile(data templateContext, filePath string) {
-	out, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0644)
+// goEnv returns the value of the go environment variable name, as seen by
+// the go command, or an empty string.
+func goEnv(name string) string {
+	out, err := exec.Command("go", "env", name).Output()
 	if err != nil {
-		die("Could not open file %s for writing: %s", filePath, out)
+		return ""
 	}
-	defer out.Close()
-
-	t := template.Must(template.New("main").Parse(mainTemplate))
-	t.Execute(out, data)
+	return strings.TrimSpace(string(out))
 }
 
-type templateContext struct {
-	OrigImport string
-	Func       string
+// readBuildInfo returns the build information embedded in binary, as printed
+// by go version -m, one tab-separated line per field, starting with the
+// go line. It runs the go command rather than reading the binary with
+// debug/buildinfo, which needs Go 1.18.
+func readBuildInfo(binary string) (string, error) {
+	out, err := exec.Command("go", "version", "-m", binary).Output()
+	if err != nil {
+		return "", fmt.Errorf("go version -m: %w", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	// The first line is "BINARY: VERSION", the others are indented.
+	i := strings.LastIndex(lines[0], ": ")
+	if i < 0 {
+		return "", fmt.Errorf("go version -m: unexpected output %q", lines[0])
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "go\t%s\n", lines[0][i+2:])
+	for _, line := range lines[1:] {
+		fmt.Fprintln(&b, strings.TrimPrefix(line, "\t"))
+	}
+	return b.String(), nil
 }
 
-const mainTemplate = `
-package main
+// checkGoExperiment returns an error if the go command rejects the value of
+// GOEXPERIMENT.
+func checkGoExperiment() error {
+	cmd := exec.Command("go", "env", "GOEXPERIMENT")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("not supported by the toolchain: %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
 
-import orig "{{.OrigImport}}"
+// goEnvVars are the environment variables that change the behavior of go
+// build. formatGoCommand includes the ones that are set.
+var goEnvVars = []string{
+	"GOOS", "GOARCH", "GOAMD64", "GOARM", "GOARM64", "GO386", "GOMIPS", "GOPPC64", "GOWASM",
+	"CGO_ENABLED", "CC", "CXX", "CGO_CFLAGS", "CGO_CPPFLAGS", "CGO_CXXFLAGS", "CGO_LDFLAGS",
+	"GOFLAGS", "GOEXPERIMENT", "GOTOOLCHAIN", "GOPROXY", "GOPRIVATE", "GONOPROXY", "GONOSUMDB", "GOSUMDB", "GOWORK",
+}
 
-func main() {
-	orig.{{.Func}}()
+// formatGoCommand returns a shell command line equivalent to running the go
+// command with args in dir.
+func formatGoCommand(dir string, args []string) string {
+	var b strings.Builder
+	b.WriteString("cd " + shellQuote(dir) + " &&")
+	for _, name := range goEnvVars {
+		if v, ok := os.LookupEnv(name); ok {
+			b.WriteString(" " + name + "=" + shellQuote(v))
+		}
+	}
+	b.WriteString(" go")
+	for _, a := range args {
+		b.WriteString(" " + shellQuote(a))
+	}
+	return b.String()
 }
-`
 
-// 1. Find the function from loc at pkg.
-// 2. Rewrite it to remove the testing.B dependency.
-// 3. Overwrite the source file on disk.
-func rewriteBenchFuncInPlace(pkgDir string, loc fnLoc) error {
-	filePath := path.Join(pkgDir, loc.file)
+// shellQuote quotes s for a POSIX shell, if needed.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_=+./,:@%") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
 
-	fset := token.NewFileSet()
-	fileAst, err := parser.ParseFile(fset, filePath, nil, 0)
+// renamePackage changes the package clause of the Go files in dir that belong
+// to package from, so that they belong to package to.
+func renamePackage(dir, from, to string) error {
+	files, err := os.ReadDir(dir)
 	if err != nil {
 		return err
 	}
-
-	var d *ast.FuncDecl
-
-	for _, decl := range fileAst.Decls {
-		fd, ok := decl.(*ast.FuncDecl)
-		if !ok {
+	for _, x := range files {
+		if x.IsDir() || !strings.HasSuffix(x.Name(), ".go") {
 			continue
 		}
-		if fd.Name.Name == loc.name {
-			d = fd
-			break
+		filePath := path.Join(dir, x.Name())
+		src, err := os.ReadFile(filePath)
+		if err != nil {
+			return err
+		}
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, filePath, src, parser.PackageClauseOnly)
+		if err != nil {
+			return err
+		}
+		if f.Name.Name != from {
+			continue
+		}
+		offset := fset.Position(f.Name.Pos()).Offset
+		out := make([]byte, 0, len(src)-len(from)+len(to))
+		out = append(out, src[:offset]...)
+		out = append(out, to...)
+		out = append(out, src[offset+len(from):]...)
+		err = os.WriteFile(filePath, out, 0644)
+		if err != nil {
+			return fmt.Errorf("writing %s: %w", filePath, err)
 		}
 	}
+	return nil
+}
 
-	if d == nil {
-		panic("could not find benchmark declaration after the files have been copied")
-	}
-
-	if d.Type.Params.NumFields() != 1 {
-		die("Function %s is expected to have exactly one parameter, but got %d", loc.name, d.Type.Params.NumFields())
-	}
-
-	testingBIdent := d.Type.Params.List[0].Names[0]
-
-	// Remove all parameters
-	// TODO: remove 'testing' import if it was the only reference in the file
-	d.Type.Params.List = nil
-
-	d.Body = removeReferencesToIdentifier(fset, testingBIdent, d.Body).(*ast.BlockStmt)
-
-	// Add go:noinline comment
-	if d.Doc == nil {
-		d.Doc = &ast.CommentGroup{}
-	}
-	d.Doc.List = append(d.Doc.List, &ast.Comment{
-		Text: "//go:noinline",
-	})
-
-	// Write out modified file
-	out, err := os.OpenFile(filePath, os.O_RDWR|os.O_TRUNC, 0755)
-	if err != nil {
-		die("Could not open file %s for writing: %s", filePath, out)
-	}
-	defer out.Close()
-	err = format.Node(out, fset, fileAst)
+func renameTestFiles(p string) error {
+	files, err := os.ReadDir(p)
 	if err != nil {
-		die("Could not format modified source: %s", err)
+		return err
 	}
+	for _, x := range files {
+		if x.IsDir() || !strings.HasSuffix(x.Name(), "_test.go") {
+			continue
+		}
 
+		newName := strings.Replace(x.Name(), "_test.go", "_bborig.go", 1)
+		fromFilePath := path.Join(p, x.Name())
+		toFilePath := path.Join(p, newName)
+		err = os.Rename(fromFilePath, toFilePath)
+		if err != nil {
+			return fmt.Errorf("renaming %s to %s: %w", fromFilePath, toFilePath, err)
+		}
+	}
 	return nil
 }
 
-func printNodeCode(fset *token.FileSet, node ast.Node) {
-	if node == nil {
-		return
-	}
-	var buf bytes.Buffer
-	err := format.Node(&buf, fset, node)
+// runGo runs the go command with args in dir. Its standard output is printed,
+// unless -quiet-go is set, and its standard error is part of the error
+// returned if it fails.
+func runGo(dir string, args ...string) error {
+	cmd := exec.Command("go", args...)
+	cmd.Dir = dir
+	out, err := cmd.Output()
 	if err != nil {
-		log.Println("warning: printNodeCode:", err)
-	}
-
-	fmt.Println(buf.String())
-}
-
-// Very not complete, also probably not sound either.
-//
-// - Removes calls of the form b.X(?)
-// - Hoist body of for statement of the form for ?; ? < b; ? {}
-//
-// TODO: do all of this better. It's also where the main complexity of this problem lies.
-func removeReferencesToIdentifier(fset *token.FileSet, id *ast.Ident, root ast.Node) ast.Node {
-	depth := 0
-	deleteMe := false
-
-	return astutil.Apply(root, func(c *astutil.Cursor) bool {
-		node := c.Node()
-
-		// fmt.Println("---------------------------------------------")
-		// fmt.Println("----[", c.Name())
-		// fmt.Println("[[[[[", depth)
-		// fmt.Printf("%T, %+v\n", node, node)
-		// printNodeCode(fset, node)
-		// fmt.Println("---------------------------------------------")
-
-		switch v := node.(type) {
-		case *ast.CallExpr:
-			f := v.Fun
-			sel, ok := f.(*ast.SelectorExpr)
-			if ok {
-				expr := sel.X
-				ident, ok := expr.(*ast.Ident)
-				if ok && ident.Obj == id.Obj {
-					deleteMe = true
-					return false
-				}
-			}
-		case *ast.ForStmt:
-			cond := v.Cond
-			op, ok := cond.(*ast.BinaryExpr)
-			if ok && op.Op == token.LSS {
-				sel, ok := op.Y.(*ast.SelectorExpr)
-				if ok {
-					expr := sel.X
-					ident, ok := expr.(*ast.Ident)
-					if ok && ident.Obj == id.Obj {
-						c.Replace(v.Body)
-						break
-					}
-				}
-			}
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			return fmt.Errorf("%w\n%s", err, strings.TrimSpace(string(exitErr.Stderr)))
 		}
-
-		depth++
-		return true
-	}, func(c *astutil.Cursor) bool {
-		depth--
-		if deleteMe && c.Index() >= 0 {
-			c.Delete()
-			deleteMe = false
-			return true
-		}
-		return true
-	})
+		return err
+	}
+	if !*quietGoFlag {
+		fmt.Fprint(logOut, string(out))
+	}
+	return nil
 }
 
 func copyModuleToTmp(fromPath, toPath string) error {
-	fmt.Println("Copying from", fromPath, "->", toPath)
+	fmt.Fprintln(logOut, "Copying from", fromPath, "->", toPath)
 	files, err := os.ReadDir(fromPath)
 	if err != nil {
 		return err
 	}
 
 	for _, x := range files {
+		if x.IsDir() && x.Name() == "testdata" {
+			// Copied as is, including any .go file: the go command
+			// ignores testdata directories.
+			fromDirPath := path.Join(fromPath, x.Name())
+			toDirPath := path.Join(toPath, x.Name())
+			err = copyTree(fromDirPath, toDirPath)
+			if err != nil {
+				return fmt.Errorf("error copying %s to %s: %w", fromDirPath, toDirPath, err)
+			}
+			fmt.Fprintln(logOut, "Copied", fromDirPath, "->", toDirPath)
+			continue
+		}
 		if x.IsDir() || !strings.HasSuffix(x.Name(), ".go") {
 			continue
 		}
@@ -378,11 +1349,33 @@ func copyModuleToTmp(fromPath, toPath string) error {
 		if err != nil {
 			return fmt.Errorf("error copying %s to %s: %w", fromFilePath, toFilePath, err)
 		}
-		fmt.Println("Copied", fromFilePath, "->", toFilePath)
+		fmt.Fprintln(logOut, "Copied", fromFilePath, "->", toFilePath)
 	}
 	return nil
 }
 
+// copyTree recursively copies the directory fromPath to toPath. Symbolic
+// links are not followed, and are skipped.
+func copyTree(fromPath, toPath string) error {
+	return filepath.WalkDir(fromPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(fromPath, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(toPath, rel)
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, 0700)
+		case d.Type().IsRegular():
+			return copyFile(p, target)
+		}
+		return nil
+	})
+}
+
 func copyFile(fromPath, toPath string) error {
 	fromFile, err := os.Open(fromPath)
 	if err != nil {
@@ -407,12 +1400,12 @@ func findBenchmarkFuncs(pkg *build.Package, nameRegex *regexp.Regexp) []fnLoc {
 	allTestFiles = append(allTestFiles, pkg.TestGoFiles...)
 	allTestFiles = append(allTestFiles, pkg.XTestGoFiles...)
 
-	for _, name := range allTestFiles {
+	for i, name := range allTestFiles {
 		fset := token.NewFileSet()
 		p := path.Join(pkg.Dir, name)
 		f, err := parser.ParseFile(fset, p, nil, 0)
 		if err != nil {
-			fmt.Printf("%s: ignored file because it could not be parsed: %s\n", p, err)
+			fmt.Fprintf(logOut, "%s: ignored file because it could not be parsed: %s\n", p, err)
 			continue
 		}
 		for _, d := range f.Decls {
@@ -420,9 +1413,15 @@ func findBenchmarkFuncs(pkg *build.Package, nameRegex *regexp.Regexp) []fnLoc {
 			if !ok || !strings.HasPrefix(fd.Name.Name, "Benchmark") || !nameRegex.MatchString(fd.Name.Name) {
 				continue
 			}
+			if fd.Recv != nil {
+				// The generated main has no receiver to call the method on.
+				fmt.Fprintf(logOut, "Ignored method (%s).%s (%s): only package-level functions are supported, call it from a Benchmark function instead\n", types.ExprString(fd.Recv.List[0].Type), fd.Name.Name, name)
+				continue
+			}
 			results = append(results, fnLoc{
-				file: name,
-				name: fd.Name.Name,
+				file:  name,
+				name:  fd.Name.Name,
+				xtest: i >= len(pkg.TestGoFiles),
 			})
 		}
 	}
@@ -433,4 +1432,54 @@ func findBenchmarkFuncs(pkg *build.Package, nameRegex *regexp.Regexp) []fnLoc {
 type fnLoc struct {
 	file string
 	name string
+	// True if the function is part of the external test package
+	// (package foo_test).
+	xtest bool
+}
+
+// xtestDir is the directory of the copied package holding the external test
+// package, if any.
+const xtestDir = "xtest"
+
+// moveXTestFiles moves the files of the external test package from dir to
+// xtestPath, so that they form their own package, and makes them import the
+// copied package at bborigImport instead of the original one.
+func moveXTestFiles(dir, xtestPath string, files []string, origImportPaths []string, bborigImport string) error {
+	err := os.Mkdir(xtestPath, 0700)
+	if err != nil {
+		return err
+	}
+	for _, name := range files {
+		fromFilePath := path.Join(dir, name)
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, fromFilePath, nil, parser.ParseComments)
+		if err != nil {
+			return err
+		}
+		for _, spec := range f.Imports {
+			p, err := strconv.Unquote(spec.Path.Value)
+			if err != nil {
+				continue
+			}
+			for _, orig := range origImportPaths {
+				if orig != "" && p == orig {
+					spec.Path.Value = strconv.Quote(bborigImport)
+				}
+			}
+		}
+		var buf bytes.Buffer
+		err = format.Node(&buf, fset, f)
+		if err != nil {
+			return fmt.Errorf("formatting %s: %w", fromFilePath, err)
+		}
+		err = os.WriteFile(path.Join(xtestPath, name), buf.Bytes(), 0644)
+		if err != nil {
+			return err
+		}
+		err = os.Remove(fromFilePath)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
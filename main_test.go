@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// goBBDir holds the go-bb binary built by buildGoBB for the tests.
+var (
+	goBBDir   string
+	goBBOnce  sync.Once
+	goBBError error
+)
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if goBBDir != "" {
+		os.RemoveAll(goBBDir)
+	}
+	os.Exit(code)
+}
+
+// buildGoBB builds go-bb, once for all the tests, and returns its path.
+func buildGoBB(t *testing.T) string {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("builds go-bb and runs the go command")
+	}
+	goBBOnce.Do(func() {
+		goBBDir, goBBError = os.MkdirTemp("", "go-bb-test-")
+		if goBBError != nil {
+			return
+		}
+		out, err := exec.Command("go", "build", "-o", filepath.Join(goBBDir, "go-bb"), ".").CombinedOutput()
+		if err != nil {
+			goBBError = fmt.Errorf("go build: %s\n%s", err, out)
+		}
+	})
+	if goBBError != nil {
+		t.Fatal(goBBError)
+	}
+	return filepath.Join(goBBDir, "go-bb")
+}
+
+// buildBenchmark runs go-bb with args and the path of the binary to build, and
+// returns the path of the binary once it ran for 10 iterations.
+func buildBenchmark(t *testing.T, args ...string) string {
+	t.Helper()
+	return buildBenchmarkEnv(t, nil, args...)
+}
+
+// buildBenchmarkEnv is buildBenchmark with the variables of env added to the
+// environment of go-bb and of the binary.
+func buildBenchmarkEnv(t *testing.T, env []string, args ...string) string {
+	t.Helper()
+	goBB := buildGoBB(t)
+	binary := filepath.Join(t.TempDir(), "benchmark.binary")
+	cmd := exec.Command(goBB, append(args, "-o", binary)...)
+	cmd.Env = append(os.Environ(), env...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("go-bb: %s\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "Benchmark binary ready at "+binary) {
+		t.Errorf("go-bb did not report the binary:\n%s", out)
+	}
+	cmd = exec.Command(binary, "10")
+	cmd.Env = append(os.Environ(), env...)
+	out, err = cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("benchmark binary: %s\n%s", err, out)
+	}
+	return binary
+}
+
+func TestExample(t *testing.T) {
+	buildBenchmark(t, "-p", "./example", "-n", "BenchmarkMe")
+}
+
+func TestMainPackage(t *testing.T) {
+	buildBenchmark(t, "-p", "./testdata/mainpkg", "-n", "BenchmarkSum")
+}
+
+func TestFindBenchmarkFuncsIgnoresMethods(t *testing.T) {
+	dir := t.TempDir()
+	src := `package p
+
+import "testing"
+
+type suite struct{}
+
+func (s *suite) BenchmarkMethod(b *testing.B) {}
+
+func BenchmarkFunc(b *testing.B) {}
+`
+	err := os.WriteFile(filepath.Join(dir, "p_test.go"), []byte(src), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkg := &build.Package{Dir: dir, TestGoFiles: []string{"p_test.go"}}
+	got := findBenchmarkFuncs(pkg, regexp.MustCompile("Benchmark"))
+	want := []fnLoc{{file: "p_test.go", name: "BenchmarkFunc"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestTestdataNotCompiled(t *testing.T) {
+	buildBenchmark(t, "-p", "./testdata/tdpkg", "-n", "BenchmarkDouble")
+}
+
+func TestCopyTestdata(t *testing.T) {
+	to := t.TempDir()
+	err := copyModuleToTmp("testdata/tdpkg", to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(to, "testdata", "broken.go")); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(filepath.Join(to, "broken.go")); err == nil {
+		t.Error("testdata/broken.go copied with the sources of the package")
+	}
+}
+
+func TestExportTestBridge(t *testing.T) {
+	buildBenchmark(t, "-p", "./testdata/xtestpkg", "-n", "BenchmarkDouble")
+}
+
+func TestReport(t *testing.T) {
+	binary := buildBenchmark(t, "-p", "./example", "-n", "BenchmarkMe", "-report")
+	out, err := exec.Command(binary, "1000").CombinedOutput()
+	if err != nil {
+		t.Fatalf("benchmark binary: %s\n%s", err, out)
+	}
+	// BenchmarkMe does not allocate in its loop.
+	if !regexp.MustCompile(`^allocations: 0 \(0 bytes\), GC cycles: \d+, peak heap: [1-9]\d* bytes\n$`).Match(out) {
+		t.Errorf("unexpected report:\n%s", out)
+	}
+}
+
+func TestCgoFiles(t *testing.T) {
+	for _, cgo := range []string{"0", "1"} {
+		t.Run("CGO_ENABLED="+cgo, func(t *testing.T) {
+			impl := "nocgo"
+			if cgo == "1" {
+				impl = "cgo"
+			}
+			buildBenchmarkEnv(t, []string{"CGO_ENABLED=" + cgo, "CGOPKG_IMPL=" + impl}, "-p", "./testdata/cgopkg", "-n", "BenchmarkImpl")
+		})
+	}
+}
+
+func TestLocalModuleHint(t *testing.T) {
+	goBB := buildGoBB(t)
+	// The packages of go-bb are not looked up, as if it were unpublished.
+	env := []string{"GOPROXY=off"}
+	cmd := exec.Command(goBB, "-p", "./testdata/localpkg", "-n", "BenchmarkTriple", "-o", filepath.Join(t.TempDir(), "benchmark.binary"))
+	cmd.Env = append(os.Environ(), env...)
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Fatalf("go-bb succeeded without -local-module:\n%s", out)
+	}
+	if !strings.Contains(string(out), "github.com/pelletier/go-bb/testdata/tdpkg is a package of github.com/pelletier/go-bb, the benchmarked module: use -local-module") {
+		t.Errorf("go-bb did not suggest -local-module:\n%s", out)
+	}
+	buildBenchmarkEnv(t, env, "-p", "./testdata/localpkg", "-n", "BenchmarkTriple", "-local-module")
+}
+
+func TestExportReuse(t *testing.T) {
+	goBB := buildGoBB(t)
+	dir := filepath.Join(t.TempDir(), "export")
+	buildBenchmark(t, "-p", "./example", "-n", "BenchmarkMe", "-export", dir)
+	exported, err := os.ReadFile(filepath.Join(dir, "main.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buildBenchmark(t, "-export", dir, "-iterations", "5")
+	buildBenchmark(t, "-p", "./example", "-n", "BenchmarkMe", "-export", dir)
+	reused, err := os.ReadFile(filepath.Join(dir, "main.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reused) != string(exported) {
+		t.Error("reusing the export changed its main.go")
+	}
+
+	for _, args := range [][]string{
+		{"-strict"},
+		{"-strip-runtime-hints"},
+		{"-multi"},
+		{"-n", "BenchmarkOther"},
+		{"-p", "./testdata/mainpkg"},
+	} {
+		out, err := exec.Command(goBB, append([]string{"-export", dir}, args...)...).CombinedOutput()
+		if err == nil {
+			t.Errorf("reusing the export with %v succeeded:\n%s", args, out)
+		} else if !strings.Contains(string(out), "must") {
+			t.Errorf("reusing the export with %v: unexpected error:\n%s", args, out)
+		}
+	}
+}
+
+func TestJSONOutput(t *testing.T) {
+	goBB := buildGoBB(t)
+	binary := filepath.Join(t.TempDir(), "benchmark.binary")
+	cmd := exec.Command(goBB, "-p", "./example", "-n", "BenchmarkMe", "-output-format", "json", "-o", binary)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("go-bb: %s\n%s", err, stderr.String())
+	}
+	var sum map[string]interface{}
+	if err := json.Unmarshal(out, &sum); err != nil {
+		t.Fatalf("stdout is not only the JSON summary: %s\n%s", err, out)
+	}
+	if sum["binary"] != binary {
+		t.Errorf("got binary %v, want %s", sum["binary"], binary)
+	}
+	if !strings.Contains(stderr.String(), "Compiling") {
+		t.Errorf("the messages are not on stderr:\n%s", stderr.String())
+	}
+}
+
+func TestEmitFuncs(t *testing.T) {
+	goBB := buildGoBB(t)
+	emitted := filepath.Join(t.TempDir(), "missing", "emitted.go")
+	out, err := exec.Command(goBB, "-p", "./testdata/emitpkg", "-n", "BenchmarkScaled", "-emit-func", emitted, "-o", filepath.Join(t.TempDir(), "benchmark.binary")).CombinedOutput()
+	if err != nil {
+		t.Fatalf("go-bb: %s\n%s", err, out)
+	}
+
+	// The emitted file must compile with the files of the package, its test
+	// files left out.
+	fset := token.NewFileSet()
+	var files []*ast.File
+	for _, name := range []string{"testdata/emitpkg/emitpkg.go", emitted} {
+		f, err := parser.ParseFile(fset, name, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, f)
+	}
+	conf := types.Config{Importer: importer.ForCompiler(fset, "source", nil)}
+	pkg, err := conf.Check("emitpkg", fset, files, nil)
+	if err != nil {
+		src, _ := os.ReadFile(emitted)
+		t.Fatalf("the emitted file does not type-check: %s\n%s", err, src)
+	}
+	if _, ok := pkg.Scope().Lookup("RunScaled").(*types.Func); !ok {
+		t.Error("the emitted file does not declare RunScaled")
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+)
+
+// matrixOutput is the -o template of the builds of -matrix when none is
+// given.
+const matrixOutput = "benchmark-{{.GOOS}}-{{.GOARCH}}"
+
+// matrixExcludedFlags are the flags not passed on to the builds of -matrix,
+// which set them themselves.
+var matrixExcludedFlags = map[string]bool{
+	"matrix":        true,
+	"goos":          true,
+	"goarch":        true,
+	"o":             true,
+	"output-format": true,
+	"progress":      true,
+}
+
+// matrixTarget is the outcome of the build of one target of -matrix.
+type matrixTarget struct {
+	Target string `json:"target"`
+	Binary string `json:"binary,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// parseMatrix splits the value of -matrix into GOOS/GOARCH targets.
+func parseMatrix(s string) ([]string, error) {
+	var targets []string
+	seen := map[string]bool{}
+	for _, t := range strings.Split(s, ",") {
+		t = strings.TrimSpace(t)
+		parts := strings.Split(t, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid target %q: expected GOOS/GOARCH", t)
+		}
+		if !seen[t] {
+			seen[t] = true
+			targets = append(targets, t)
+		}
+	}
+	return targets, nil
+}
+
+// splitTarget returns the GOOS and GOARCH of a target of -matrix.
+func splitTarget(t string) (goos, goarch string) {
+	i := strings.Index(t, "/")
+	return t[:i], t[i+1:]
+}
+
+// checkMatrixOutput returns an error if the -o template tmpl gives the same
+// path to two targets.
+func checkMatrixOutput(tmpl *template.Template, targets []string) error {
+	paths := map[string]string{}
+	for _, t := range targets {
+		goos, goarch := splitTarget(t)
+		var b strings.Builder
+		err := tmpl.Execute(&b, outputContext{GOOS: goos, GOARCH: goarch})
+		if err != nil {
+			return err
+		}
+		if other, ok := paths[b.String()]; ok {
+			return fmt.Errorf("%s and %s would both be written to %s; use {{.GOOS}} and {{.GOARCH}}", other, t, b.String())
+		}
+		paths[b.String()] = t
+	}
+	return nil
+}
+
+// matrixArgs returns the command line flags of go-bb to pass on to the builds
+// of -matrix.
+func matrixArgs() []string {
+	var args []string
+	flag.Visit(func(f *flag.Flag) {
+		if matrixExcludedFlags[f.Name] {
+			return
+		}
+		if values, ok := f.Value.(*stringsFlag); ok {
+			for _, v := range *values {
+				args = append(args, "-"+f.Name+"="+v)
+			}
+			return
+		}
+		args = append(args, "-"+f.Name+"="+f.Value.String())
+	})
+	return args
+}
+
+// runMatrix builds the benchmark for each of targets, by running go-bb again
+// with -goos and -goarch, and the -o template output. The failure of a target
+// does not stop the others.
+func runMatrix(targets []string, output string) ([]matrixTarget, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	args := matrixArgs()
+
+	results := make([]matrixTarget, 0, len(targets))
+	for _, t := range targets {
+		goos, goarch := splitTarget(t)
+		fmt.Fprintln(logOut, "Building for", t)
+		cmd := exec.Command(self, append(args, "-goos="+goos, "-goarch="+goarch, "-o="+output, "-output-format=json")...)
+		var stdout, stderr bytes.Buffer
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		err := cmd.Run()
+
+		// The summary, alone on stdout with -output-format json, and the
+		// messages of the build.
+		fmt.Fprint(logOut, indent(stderr.String(), "  "))
+
+		res := matrixTarget{Target: t}
+		var sum summary
+		switch {
+		case err != nil:
+			res.Error = lastLine(stderr.String())
+			if res.Error == "" {
+				res.Error = err.Error()
+			}
+		case json.Unmarshal(stdout.Bytes(), &sum) != nil:
+			res.Error = "could not read the summary of the build"
+		default:
+			res.Binary = sum.Binary
+			res.Size = sum.Size
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// lastLine returns the last non-empty line of s.
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// writeMatrix prints the outcome of each target of -matrix in format.
+func writeMatrix(w io.Writer, results []matrixTarget, format string) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(results)
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "TARGET\tSTATUS\tSIZE\tBINARY")
+	for _, r := range results {
+		if r.Error != "" {
+			fmt.Fprintf(tw, "%s\tfailed\t\t%s\n", r.Target, r.Error)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\tok\t%s\t%s\n", r.Target, formatSize(r.Size), r.Binary)
+	}
+	return tw.Flush()
+}
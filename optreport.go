@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// lineRange is a range of lines of a file of the prepared module, relative to
+// its root.
+type lineRange struct {
+	file        string
+	first, last int
+}
+
+// optReport builds the prepared module in dir again, with the flags of
+// buildArgs and -gcflags=-m for the copied packages, and returns the
+// inlining and escape analysis decisions the compiler reports about the
+// benchmark functions and the functions of the copied package they call,
+// directly or not. buildArgs start with build -o BINARY; gcflags are the
+// compiler flags the binary was built with, if any.
+func optReport(mod preparedModule, buildArgs []string, gcflags string) ([]string, error) {
+	ranges, err := hotFuncRanges(mod)
+	if err != nil {
+		return nil, err
+	}
+
+	flags := strings.TrimSpace(gcflags + " -m")
+	args := append([]string{"build", "-o", os.DevNull}, buildArgs[3:]...)
+	args = append(args, "-gcflags="+mod.bborigImport()+"/...="+flags)
+	cmd := exec.Command("go", args...)
+	cmd.Dir = mod.Dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("%w\n%s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var lines []string
+	seen := map[string]bool{}
+	for _, line := range strings.Split(stderr.String(), "\n") {
+		m := diagnosticRegexp.FindStringSubmatch(line)
+		if m == nil || seen[line] {
+			continue
+		}
+		n, _ := strconv.Atoi(m[2])
+		for _, r := range ranges {
+			if r.file == m[1] && r.first <= n && n <= r.last {
+				seen[line] = true
+				lines = append(lines, line)
+				break
+			}
+		}
+	}
+	sort.SliceStable(lines, func(i, j int) bool {
+		a := diagnosticRegexp.FindStringSubmatch(lines[i])
+		b := diagnosticRegexp.FindStringSubmatch(lines[j])
+		if a[1] != b[1] {
+			return a[1] < b[1]
+		}
+		x, _ := strconv.Atoi(a[2])
+		y, _ := strconv.Atoi(b[2])
+		return x < y
+	})
+	for i, line := range lines {
+		lines[i] = mod.origPositions(line)
+	}
+	return lines, nil
+}
+
+// diagnosticRegexp matches a diagnostic of the compiler, FILE:LINE:COL: MSG,
+// about a file of the copied packages.
+var diagnosticRegexp = regexp.MustCompile(`^(?:\./)?(bborig/[^\s:]+\.go):(\d+):\d+: `)
+
+// hotFuncRanges returns the lines of the benchmark functions of mod, and of
+// the package-level functions of the copied package they call, directly or
+// through one another.
+func hotFuncRanges(mod preparedModule) ([]lineRange, error) {
+	fset := token.NewFileSet()
+	// Declarations by package (the copied one, or its external test
+	// package) and name.
+	decls := map[bool]map[string]*ast.FuncDecl{}
+	// Name the external test package imports the copied one with.
+	qualifier := ""
+	for _, xtest := range []bool{false, true} {
+		dir := path.Join(mod.Dir, "bborig")
+		if xtest {
+			dir = path.Join(dir, xtestDir)
+		}
+		decls[xtest] = map[string]*ast.FuncDecl{}
+		pkgs, err := parser.ParseDir(fset, dir, nil, 0)
+		if err != nil {
+			if xtest && os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, pkg := range pkgs {
+			for _, f := range pkg.Files {
+				for _, d := range f.Decls {
+					if fd, ok := d.(*ast.FuncDecl); ok && fd.Recv == nil && fd.Body != nil {
+						decls[xtest][fd.Name.Name] = fd
+					}
+				}
+				for _, spec := range f.Imports {
+					if xtest && strings.Trim(spec.Path.Value, `"`) == mod.bborigImport() {
+						qualifier = mod.Package
+						if spec.Name != nil {
+							qualifier = spec.Name.Name
+						}
+					}
+				}
+			}
+		}
+	}
+
+	type key struct {
+		xtest bool
+		name  string
+	}
+	visited := map[key]bool{}
+	var queue []key
+	for _, f := range mod.Functions {
+		queue = append(queue, key{f.XTest, f.symbol()})
+	}
+
+	var ranges []lineRange
+	for len(queue) > 0 {
+		k := queue[0]
+		queue = queue[1:]
+		d := decls[k.xtest][k.name]
+		if visited[k] || d == nil {
+			continue
+		}
+		visited[k] = true
+
+		start := fset.Position(d.Pos())
+		file := strings.TrimPrefix(start.Filename, mod.Dir+"/")
+		ranges = append(ranges, lineRange{file, start.Line, fset.Position(d.End()).Line})
+
+		ast.Inspect(d.Body, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			switch fun := call.Fun.(type) {
+			case *ast.Ident:
+				queue = append(queue, key{k.xtest, fun.Name})
+			case *ast.SelectorExpr:
+				if x, ok := fun.X.(*ast.Ident); ok && k.xtest && qualifier != "" && x.Name == qualifier {
+					queue = append(queue, key{false, fun.Sel.Name})
+				}
+			}
+			return true
+		})
+	}
+	return ranges, nil
+}
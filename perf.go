@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"debug/elf"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// checkSymbols returns a warning if the ELF binary at binaryPath lacks the
+// symbol table or the DWARF information perf needs to symbolize it, or an
+// empty string. Binaries in other formats are not checked.
+func checkSymbols(binaryPath string) string {
+	f, err := elf.Open(binaryPath)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	if f.Section(".symtab") == nil {
+		return "the binary has no symbol table (was it built with -ldflags=-s?), perf cannot symbolize it"
+	}
+	if f.Section(".debug_info") == nil && f.Section(".zdebug_info") == nil {
+		return "the binary has no DWARF information (was it built with -ldflags=-w?), perf cannot resolve source lines nor inlined calls"
+	}
+	return ""
+}
+
+// writePerfMap writes the function symbols of the ELF binary at binaryPath to
+// mapPath, in the format of the /tmp/perf-PID.map files perf reads: one
+// "START SIZE NAME" line per function, with addresses in hexadecimal.
+func writePerfMap(binaryPath, mapPath string) error {
+	f, err := elf.Open(binaryPath)
+	if err != nil {
+		return fmt.Errorf("perf maps are only supported for ELF binaries: %w", err)
+	}
+	defer f.Close()
+
+	syms, err := f.Symbols()
+	if err != nil {
+		return err
+	}
+	funcs := syms[:0]
+	for _, s := range syms {
+		if elf.ST_TYPE(s.Info) == elf.STT_FUNC && s.Value != 0 && s.Size != 0 {
+			funcs = append(funcs, s)
+		}
+	}
+	sort.Slice(funcs, func(i, j int) bool {
+		return funcs[i].Value < funcs[j].Value
+	})
+
+	out, err := os.Create(mapPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+	for _, s := range funcs {
+		fmt.Fprintf(w, "%x %x %s\n", s.Value, s.Size, s.Name)
+	}
+	err = w.Flush()
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
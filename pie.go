@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"go/build"
+	"os"
+	"strings"
+)
+
+// piePlatforms are the platforms on which -buildmode=pie is supported, as of
+// Go 1.22 (internal/platform.BuildModeSupported).
+var piePlatforms = map[string]bool{
+	"aix/ppc64":     true,
+	"android/386":   true,
+	"android/amd64": true,
+	"android/arm":   true,
+	"android/arm64": true,
+	"darwin/amd64":  true,
+	"darwin/arm64":  true,
+	"freebsd/amd64": true,
+	"ios/amd64":     true,
+	"ios/arm64":     true,
+	"linux/386":     true,
+	"linux/amd64":   true,
+	"linux/arm":     true,
+	"linux/arm64":   true,
+	"linux/loong64": true,
+	"linux/ppc64le": true,
+	"linux/riscv64": true,
+	"linux/s390x":   true,
+	"openbsd/arm64": true,
+	"windows/386":   true,
+	"windows/amd64": true,
+	"windows/arm":   true,
+	"windows/arm64": true,
+}
+
+// internalLinkPIEPlatforms are the platforms on which the Go linker can link
+// a position-independent executable itself
+// (internal/platform.InternalLinkPIESupported). On the others, it needs an
+// external linker, thus cgo.
+var internalLinkPIEPlatforms = map[string]bool{
+	"android/arm64": true,
+	"darwin/amd64":  true,
+	"darwin/arm64":  true,
+	"linux/amd64":   true,
+	"linux/arm64":   true,
+	"linux/loong64": true,
+	"linux/ppc64le": true,
+	"windows/386":   true,
+	"windows/amd64": true,
+	"windows/arm64": true,
+}
+
+// checkPIE returns a warning if building a position-independent executable
+// for the target is not supported or is likely to fail, or an empty string.
+func checkPIE() string {
+	platform := build.Default.GOOS + "/" + build.Default.GOARCH
+	if !piePlatforms[platform] {
+		return fmt.Sprintf("-buildmode=pie is not supported on %s", platform)
+	}
+	if !internalLinkPIEPlatforms[platform] && !build.Default.CgoEnabled {
+		return fmt.Sprintf("-buildmode=pie may need external linking on %s, which requires cgo, but cgo is disabled (CGO_ENABLED=0, or cross-compiling without CC)", platform)
+	}
+	if strings.Contains(os.Getenv("GOFLAGS"), "-static") {
+		return "GOFLAGS asks for static linking, which position-independent executables only support with a linker able to produce static-pie binaries"
+	}
+	return ""
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// killGracePeriod is how long a benchmark interrupted by -benchmark-timeout
+// has to write its profile and exit, before it is killed.
+const killGracePeriod = 5 * time.Second
+
+// mergeProfiles runs each benchmark of the -multi binary at binaryPath with
+// CPU profiling, and merges their profiles into outPath with go tool pprof.
+// The benchmarks run in dir, or the current directory if it is empty, for at
+// most timeout each if it is positive.
+func mergeProfiles(binaryPath, dir string, names []string, outPath string, timeout time.Duration) (err error) {
+	tmp, err := makeTempDir()
+	if err != nil {
+		return err
+	}
+	defer removeUnlessTimedOut(tmp, &err)
+
+	profiles := make([]string, 0, len(names))
+	for i, name := range names {
+		profile := filepath.Join(tmp, fmt.Sprintf("%d.pprof", i))
+		fmt.Fprintln(logOut, "Profiling", name)
+		err := profileRun(binaryPath, dir, []string{name}, profile, timeout)
+		if err != nil {
+			return fmt.Errorf("running %s: %w", name, err)
+		}
+		profiles = append(profiles, profile)
+	}
+
+	fmt.Fprintln(logOut, "Merging profiles")
+	out, err := os.Create(outPath)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("go", append([]string{"tool", "pprof", "-proto"}, profiles...)...)
+	cmd.Stdout = out
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		out.Close()
+		return fmt.Errorf("go tool pprof: %w", err)
+	}
+	return out.Close()
+}
+
+// profileRun runs the binary at binaryPath with args in dir, or the current
+// directory if it is empty, and has it write its CPU profile to profile. If
+// timeout is positive and the run lasts longer, it is interrupted, so that it
+// writes what it has of its profile, then killed after killGracePeriod.
+func profileRun(binaryPath, dir string, args []string, profile string, timeout time.Duration) error {
+	cmd := exec.Command(binaryPath, args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), cpuProfileEnv+"="+profile)
+	cmd.Stdout = logOut
+	cmd.Stderr = os.Stderr
+	if timeout <= 0 {
+		return cmd.Run()
+	}
+
+	setProcessGroup(cmd)
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+	}
+
+	if interruptProcess(cmd) != nil {
+		killProcess(cmd)
+	}
+	select {
+	case <-done:
+	case <-time.After(killGracePeriod):
+		killProcess(cmd)
+		<-done
+	}
+	return &timeoutError{timeout, profile}
+}
+
+// timeoutError is the error of a run of profileRun interrupted after timeout.
+type timeoutError struct {
+	timeout time.Duration
+	profile string
+}
+
+func (e *timeoutError) Error() string {
+	msg := fmt.Sprintf("timed out after %s", e.timeout)
+	if fi, err := os.Stat(e.profile); err == nil && fi.Size() > 0 {
+		msg += "; the CPU profile written until then is at " + e.profile
+	}
+	return msg
+}
+
+// removeUnlessTimedOut removes the temporary directory dir, unless *err is a
+// timeoutError, whose profile may be in dir.
+func removeUnlessTimedOut(dir string, err *error) {
+	var te *timeoutError
+	if !errors.As(*err, &te) {
+		os.RemoveAll(dir)
+	}
+}
+
+// writeFoldedProfile writes the folded stacks of the benchmarks of the
+// binary at binaryPath to sum.Folded. The merged profile is converted if
+// there is one, else the benchmarks are run with CPU profiling in dir, for
+// at most timeout each if it is positive.
+func writeFoldedProfile(mod preparedModule, binaryPath, dir string, sum summary, timeout time.Duration) (err error) {
+	profile := sum.MergedProfile
+	if profile == "" {
+		tmp, err := makeTempDir()
+		if err != nil {
+			return err
+		}
+		defer removeUnlessTimedOut(tmp, &err)
+		profile = filepath.Join(tmp, "cpu.pprof")
+		if mod.Multi {
+			err = mergeProfiles(binaryPath, dir, sum.Functions, profile, timeout)
+		} else {
+			fmt.Fprintln(logOut, "Profiling", sum.Functions[0])
+			err = profileRun(binaryPath, dir, nil, profile, timeout)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Fprintln(logOut, "Folding stacks")
+	return writeFolded(profile, sum.Folded, mod.origSymbol)
+}
+
+// tracesValueWidth is the width of the column of the values in the output
+// of go tool pprof -traces, before the "+" of its separator lines.
+const tracesValueWidth = 11
+
+// writeFolded converts the CPU profile at profilePath to outPath, in the
+// folded stacks format of flamegraph.pl: one "root;...;leaf COUNT" line per
+// distinct stack, where COUNT is its number of samples. rename is applied
+// to each function name.
+func writeFolded(profilePath, outPath string, rename func(string) string) error {
+	cmd := exec.Command("go", "tool", "pprof", "-sample_index=samples", "-traces", profilePath)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("go tool pprof: %w\n%s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	// Each trace is a separator line, then its leaf with the value of the
+	// sample, then its callers, one per line.
+	counts := map[string]int64{}
+	var frames []string
+	var count int64
+	flush := func() {
+		if len(frames) > 0 {
+			for i, j := 0, len(frames)-1; i < j; i, j = i+1, j-1 {
+				frames[i], frames[j] = frames[j], frames[i]
+			}
+			counts[strings.Join(frames, ";")] += count
+		}
+		frames = frames[:0]
+	}
+	inTraces := false
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, strings.Repeat("-", tracesValueWidth)+"+") {
+			flush()
+			inTraces = true
+			continue
+		}
+		if !inTraces || len(line) <= tracesValueWidth {
+			continue
+		}
+		if v := strings.TrimSpace(line[:tracesValueWidth]); v != "" {
+			count, err = strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return fmt.Errorf("unexpected go tool pprof -traces line %q", line)
+			}
+		}
+		frame := strings.TrimSuffix(strings.TrimSpace(line[tracesValueWidth:]), " (inline)")
+		// Semicolons separate the frames, and the last space the count.
+		frame = strings.NewReplacer(";", ":", " ", "_").Replace(rename(frame))
+		frames = append(frames, frame)
+	}
+	flush()
+
+	stacks := make([]string, 0, len(counts))
+	for stack := range counts {
+		stacks = append(stacks, stack)
+	}
+	sort.Strings(stacks)
+
+	f, err := os.Create(outPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, stack := range stacks {
+		fmt.Fprintf(w, "%s %d\n", stack, counts[stack])
+	}
+	err = w.Flush()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// progressEvent is a line of the -progress stream. A phase starts with a
+// start event, and ends with a done event, or a failed one if go-bb gives up
+// during it.
+type progressEvent struct {
+	Time  time.Time `json:"time"`
+	Phase string    `json:"phase"`
+	// start, done or failed.
+	Event string `json:"event"`
+	// Duration of the phase, in done and failed events.
+	Seconds float64 `json:"seconds,omitempty"`
+	// Message go-bb exits with, in failed events.
+	Error string `json:"error,omitempty"`
+}
+
+var (
+	// Destination of the -progress stream, or nil.
+	progressOut io.Writer
+	// Phase in progress, and when it started.
+	currentPhase string
+	phaseStart   time.Time
+)
+
+// openProgress sets the destination of the -progress stream: stdout, stderr,
+// or else the file named dest, which is truncated.
+func openProgress(dest string) error {
+	switch dest {
+	case "stdout":
+		progressOut = os.Stdout
+	case "stderr":
+		progressOut = os.Stderr
+	default:
+		f, err := os.Create(dest)
+		if err != nil {
+			return err
+		}
+		// Written line by line, and closed on exit.
+		progressOut = f
+		atExit(func() { f.Close() })
+	}
+	return nil
+}
+
+func emitProgress(e progressEvent) {
+	if progressOut == nil {
+		return
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(progressOut, "%s\n", data)
+}
+
+// startPhase ends the phase in progress, if any, and starts the phase name.
+func startPhase(name string) {
+	endPhase()
+	currentPhase = name
+	phaseStart = time.Now()
+	emitProgress(progressEvent{Time: phaseStart, Phase: name, Event: "start"})
+}
+
+// endPhase ends the phase in progress, if any.
+func endPhase() {
+	if currentPhase == "" {
+		return
+	}
+	now := time.Now()
+	emitProgress(progressEvent{Time: now, Phase: currentPhase, Event: "done", Seconds: now.Sub(phaseStart).Seconds()})
+	currentPhase = ""
+}
+
+// failPhase ends the phase in progress, if any, with the error msg.
+func failPhase(msg string) {
+	if currentPhase == "" {
+		return
+	}
+	now := time.Now()
+	emitProgress(progressEvent{Time: now, Phase: currentPhase, Event: "failed", Seconds: now.Sub(phaseStart).Seconds(), Error: msg})
+	currentPhase = ""
+}
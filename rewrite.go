@@ -0,0 +1,1956 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+// rewriteOptions controls how the benchmark function is rewritten.
+type rewriteOptions struct {
+	// Name of the package-level variable substituted for b.N.
+	iterationsVar string
+	// If not empty, name of a package-level func(bool) bool wrapping the
+	// condition of the benchmark loop, called at the start of each
+	// iteration and when the loop ends.
+	tickFunc string
+	// If not empty, import path of the package declaring iterationsVar and
+	// tickFunc, when it is not the package of the benchmark. hooksPackage
+	// is its package name.
+	hooksImport  string
+	hooksPackage string
+	// Name the hooks are qualified with in the rewritten file. Set by
+	// rewriteBenchFuncInPlace.
+	hooksQualifier string
+	// If true, remove the calls to the functions of runtimeHints.
+	stripRuntimeHints bool
+	// If not empty, name of a package-level type with no-op methods that b
+	// is rebound to, instead of removing the calls of its methods and
+	// substituting b.N.
+	stubType string
+	// If true, remove the calls of the bookkeepingMethods of b even when
+	// calls of its methods are kept.
+	stripBookkeeping bool
+	// If true, replace the calls of the logMethods of b by calls of their
+	// hooks, instead of removing them.
+	keepLogs bool
+	// If not empty, new name of the benchmark function.
+	rename string
+	// If true, replace the calls of the timerMethods of b by calls of
+	// their hooks, and start the benchmark with a call of timerSetupHook if
+	// it calls b.ResetTimer.
+	timerLabels bool
+	// If not empty, patterns of the names of the sub-benchmarks to run,
+	// one per level, instead of the whole benchmark.
+	subBenchmarks []*regexp.Regexp
+	// Name of the benchmark, as go test reports it, which b.Name() is
+	// replaced by. Set by rewriteBenchFuncInPlace.
+	benchName string
+	// If true, fail on the calls of the alteringMethods of b instead of
+	// rewriting them.
+	strict bool
+	// If not nil, the changes of the rewrite to the code of the benchmarks
+	// are appended to it, at their lines in the original files of origDir.
+	changes *[]rewriteChange
+	origDir string
+	// Records a change at a position of the file set of the rewrite. Set by
+	// rewriteBenchFuncInPlace.
+	record func(pos token.Pos, change string)
+}
+
+// rewriteChange is a change of the rewrite to the code of a benchmark or of
+// its helpers: a call of b removed or replaced, or a statement rewritten.
+type rewriteChange struct {
+	File   string `json:"file"`
+	Line   int    `json:"line"`
+	Change string `json:"change"`
+}
+
+// recordChange records the change described by format and args at pos, if
+// the changes are recorded.
+func (opts rewriteOptions) recordChange(pos token.Pos, format string, args ...interface{}) {
+	if opts.record != nil {
+		opts.record(pos, fmt.Sprintf(format, args...))
+	}
+}
+
+// methodCallString returns how the call of the method sel of b is shown in
+// the changes: b.Method() or b.Method(...).
+func methodCallString(sel *ast.SelectorExpr, call *ast.CallExpr) string {
+	args := ""
+	if len(call.Args) > 0 {
+		args = "..."
+	}
+	return fmt.Sprintf("%s.%s(%s)", sel.X.(*ast.Ident).Name, sel.Sel.Name, args)
+}
+
+// bookkeepingMethods are the methods of testing.B that only control or
+// report the measurements of the testing framework.
+var bookkeepingMethods = map[string]bool{
+	"ReportAllocs": true,
+	"ReportMetric": true,
+	"ResetTimer":   true,
+	"SetBytes":     true,
+	"StartTimer":   true,
+	"StopTimer":    true,
+}
+
+// logMethods maps the logging methods of testing.B to the hooks printing
+// their arguments that they are replaced by with -keep-logs.
+var logMethods = map[string]string{
+	"Log":  "GoBBLog",
+	"Logf": "GoBBLogf",
+}
+
+// timerMethods maps the timer methods of testing.B to the hooks labelling the
+// CPU profile samples that they are replaced by with -timer-labels.
+var timerMethods = map[string]string{
+	"ResetTimer": "GoBBResetTimer",
+	"StartTimer": "GoBBStartTimer",
+	"StopTimer":  "GoBBStopTimer",
+}
+
+// valueMethods maps the methods of testing.B returning a value to hooks
+// returning a replacement value; b.Name is replaced by the name of the benchmark.
+var valueMethods = map[string]string{
+	"Elapsed": "GoBBElapsed",
+	"Failed":  "GoBBFailed",
+	"Name":    "",
+	"Skipped": "GoBBSkipped",
+	"TempDir": "GoBBTempDir",
+}
+
+// methodValue returns the expression replacing the call of the method name
+// of b used as a value, or nil if there is none.
+func (opts rewriteOptions) methodValue(pos token.Pos, name string) ast.Expr {
+	v, ok := valueMethods[name]
+	switch {
+	case !ok:
+		return nil
+	case name == "Name" && opts.benchName == "":
+		return nil
+	case name == "Name":
+		return &ast.BasicLit{ValuePos: pos, Kind: token.STRING, Value: strconv.Quote(opts.benchName)}
+	}
+	return &ast.CallExpr{Fun: opts.hookRef(pos, v), Lparen: pos, Rparen: pos}
+}
+
+// failMethods maps the methods of testing.B reporting failures and skips to
+// the hooks printing their arguments and recording the outcome, which main
+// reports once the benchmark returns. Like in go test, the ones stopping the
+// benchmark end the goroutine calling them.
+var failMethods = map[string]string{
+	"Error":   "GoBBError",
+	"Errorf":  "GoBBErrorf",
+	"Fail":    "GoBBFail",
+	"FailNow": "GoBBFailNow",
+	"Fatal":   "GoBBFatal",
+	"Fatalf":  "GoBBFatalf",
+	"Skip":    "GoBBSkip",
+	"SkipNow": "GoBBSkipNow",
+	"Skipf":   "GoBBSkipf",
+}
+
+// alteringMethods maps the methods of testing.B whose calls cannot be
+// rewritten without changing what the benchmark does to how, for -strict. The
+// methods of the stub type do what they do under go test.
+var alteringMethods = map[string]string{
+	"Chdir":   "the working directory is not changed like under go test",
+	"Cleanup": "the functions it registers are never run",
+	"Elapsed": "it returns 0",
+	"Setenv":  "the environment is not changed like under go test",
+	"TempDir": "the directory is not removed once the benchmark returns",
+}
+
+// findAlteringCall returns the first call of root of one of the
+// alteringMethods of id, or nil.
+func findAlteringCall(root ast.Node, id *ast.Ident) *ast.CallExpr {
+	var found *ast.CallExpr
+	ast.Inspect(root, func(n ast.Node) bool {
+		if found != nil {
+			return false
+		}
+		call, ok := n.(*ast.CallExpr)
+		if !ok {
+			return true
+		}
+		sel, ok := call.Fun.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		if x, ok := sel.X.(*ast.Ident); ok && x.Obj == id.Obj && alteringMethods[sel.Sel.Name] != "" {
+			found = call
+		}
+		return true
+	})
+	return found
+}
+
+// stubMethods are the methods of the stub type, the ones of testing.B it
+// provides.
+var stubMethods = map[string]bool{
+	"ArtifactDir":    true,
+	"Attr":           true,
+	"Chdir":          true,
+	"Cleanup":        true,
+	"Context":        true,
+	"Elapsed":        true,
+	"Error":          true,
+	"Errorf":         true,
+	"Fail":           true,
+	"FailNow":        true,
+	"Failed":         true,
+	"Fatal":          true,
+	"Fatalf":         true,
+	"Helper":         true,
+	"Log":            true,
+	"Logf":           true,
+	"Loop":           true,
+	"Name":           true,
+	"Output":         true,
+	"ReportAllocs":   true,
+	"ReportMetric":   true,
+	"ResetTimer":     true,
+	"Run":            true,
+	"RunParallel":    true,
+	"SetBytes":       true,
+	"SetParallelism": true,
+	"Setenv":         true,
+	"Skip":           true,
+	"SkipNow":        true,
+	"Skipf":          true,
+	"Skipped":        true,
+	"StartTimer":     true,
+	"StopTimer":      true,
+	"TempDir":        true,
+}
+
+// unsupportedMethodValue ends the message rejecting the use of the result of
+// the method name of b: -inline-stubs is only suggested if the stub type
+// has the method.
+func unsupportedMethodValue(name string) string {
+	if stubMethods[name] {
+		return "this is not supported without -inline-stubs"
+	}
+	return "this is not supported"
+}
+
+// findUnknownMethod returns the first selection of root of a field or method
+// of id that the stub type does not have, or nil.
+func findUnknownMethod(root ast.Node, id *ast.Ident) *ast.SelectorExpr {
+	var found *ast.SelectorExpr
+	ast.Inspect(root, func(n ast.Node) bool {
+		if found != nil {
+			return false
+		}
+		sel, ok := n.(*ast.SelectorExpr)
+		if !ok || sel.Sel.Name == "N" || stubMethods[sel.Sel.Name] {
+			return true
+		}
+		if x, ok := sel.X.(*ast.Ident); ok && x.Obj == id.Obj {
+			found = sel
+		}
+		return true
+	})
+	return found
+}
+
+// parallelMethods maps the methods of testing.B running parallel benchmarks
+// to the hooks running them on a pool of goroutines.
+var parallelMethods = map[string]string{
+	"RunParallel":    "GoBBRunParallel",
+	"SetParallelism": "GoBBSetParallelism",
+}
+
+// pbType is the type of the copied package replacing testing.PB, the
+// iterator of b.RunParallel.
+const pbType = "GoBBPB"
+
+// timerSetupHook is the hook labelling the samples of the setup of a
+// benchmark, until it calls b.ResetTimer, with -timer-labels.
+const timerSetupHook = "GoBBSetupTimer"
+
+// runtimeHints are the functions of the runtime package benchmarks call to
+// tune the measurements of the testing framework.
+var runtimeHints = map[string]bool{
+	"GC":      true,
+	"Gosched": true,
+}
+
+// hookRef returns an expression referring to the hook name at pos.
+func (opts rewriteOptions) hookRef(pos token.Pos, name string) ast.Expr {
+	ident := &ast.Ident{NamePos: pos, Name: name}
+	if opts.hooksQualifier == "" {
+		return ident
+	}
+	return &ast.SelectorExpr{
+		X:   &ast.Ident{NamePos: pos, Name: opts.hooksQualifier},
+		Sel: ident,
+	}
+}
+
+// hooksQualifier returns the name the file refers to the package at
+// importPath, named pkgName, with. The import is added if the file does not
+// have it yet.
+func hooksQualifier(fset *token.FileSet, f *ast.File, importPath, pkgName string) string {
+	for _, spec := range f.Imports {
+		if strings.Trim(spec.Path.Value, `"`) != importPath {
+			continue
+		}
+		if spec.Name == nil {
+			return pkgName
+		}
+		switch spec.Name.Name {
+		case "_":
+			continue
+		case ".":
+			return ""
+		}
+		return spec.Name.Name
+	}
+	astutil.AddNamedImport(fset, f, pkgName, importPath)
+	return pkgName
+}
+
+// 1. Find the function from loc at pkg.
+// 2. Rewrite it to remove the testing.B dependency.
+// 3. Overwrite the source file on disk.
+func rewriteBenchFuncInPlace(pkgDir string, loc fnLoc, opts rewriteOptions) error {
+	filePath := path.Join(pkgDir, loc.file)
+
+	fset := token.NewFileSet()
+	fileAst, err := parser.ParseFile(fset, filePath, nil, parser.ParseComments)
+	if err != nil {
+		return err
+	}
+
+	d := findFuncDecl(fileAst, loc.name)
+	if d == nil {
+		panic("could not find benchmark declaration after the files have been copied")
+	}
+
+	if d.Type.Params.NumFields() != 1 {
+		die("Function %s is expected to have exactly one parameter, but got %d", loc.name, d.Type.Params.NumFields())
+	}
+
+	testingBIdent := d.Type.Params.List[0].Names[0]
+
+	if opts.hooksImport != "" {
+		opts.hooksQualifier = hooksQualifier(fset, fileAst, opts.hooksImport, opts.hooksPackage)
+	}
+
+	if changes := opts.changes; changes != nil {
+		// The benchmarks of the file rewritten before this one may
+		// have moved it: its changes are recorded at the lines of the
+		// original file.
+		shift := 0
+		origFset := token.NewFileSet()
+		if f, err := parser.ParseFile(origFset, path.Join(opts.origDir, loc.file), nil, 0); err == nil {
+			if orig := findFuncDecl(f, loc.name); orig != nil {
+				shift = origFset.Position(orig.Pos()).Line - fset.Position(d.Pos()).Line
+			}
+		}
+		opts.record = func(pos token.Pos, change string) {
+			p := fset.Position(pos)
+			if p.Filename == filePath {
+				p.Line += shift
+			}
+			*changes = append(*changes, rewriteChange{File: path.Join(opts.origDir, path.Base(p.Filename)), Line: p.Line, Change: change})
+		}
+	}
+
+	// Remove all parameters
+	d.Type.Params.List = nil
+
+	// The parameter of the benchmark, and the one of its only sub-benchmark
+	// if its body is inlined, with the blocks they are used in.
+	// The names of the benchmarks they are the parameter of, as go test
+	// reports them, or "" if unknown.
+	params := []*ast.Ident{testingBIdent}
+	blocks := []*ast.BlockStmt{d.Body}
+	name := loc.name
+	names := []string{name}
+	for _, re := range opts.subBenchmarks {
+		inner, block, sub, err := selectSubBenchmark(fset, loc, blocks[len(blocks)-1], params[len(params)-1], re)
+		if err != nil {
+			return err
+		}
+		name += "/" + sub
+		fmt.Fprintf(logOut, "Selected the sub-benchmark %s\n", name)
+		opts.recordChange(block.Pos(), "ran the sub-benchmark %s in place of its parent, without the other ones", name)
+		params = append(params, inner)
+		blocks = append(blocks, block)
+		names = append(names, name)
+	}
+	subs, _ := subBenchmarkNames(blocks[len(blocks)-1], params[len(params)-1])
+	if inner, block := inlineSingleRun(blocks[len(blocks)-1], params[len(params)-1]); inner != nil {
+		fmt.Fprintf(logOut, "Inlined the only sub-benchmark of %s\n", name)
+		opts.recordChange(block.Pos(), "ran the body of the only sub-benchmark in place of %s.Run", params[len(params)-1].Name)
+		params = append(params, inner)
+		blocks = append(blocks, block)
+		if subs[0] == "?" {
+			names = append(names, "")
+		} else {
+			names = append(names, name+"/"+subs[0])
+		}
+	}
+	// The stub type runs them all, the rewrite removes them.
+	if names, pos := subBenchmarkNames(blocks[len(blocks)-1], params[len(params)-1]); len(names) > 0 && opts.stubType != "" {
+		fmt.Fprintf(logOut, "Warning: %s:%d: %s runs the sub-benchmarks %s, which all run, one after the other, each for the number of iterations; select one with -n %s/NAME\n", loc.file, fset.Position(pos).Line, name, strings.Join(names, ", "), name)
+	} else if len(names) > 0 {
+		fmt.Fprintf(logOut, "Warning: %s:%d: %s runs the sub-benchmarks %s, which are removed; select one with -n %s/NAME\n", loc.file, fset.Position(pos).Line, name, strings.Join(names, ", "), name)
+		opts.recordChange(pos, "removed the sub-benchmarks %s", strings.Join(names, ", "))
+	}
+
+	for _, id := range params {
+		for _, alias := range resolveAliases(d.Body, id) {
+			fmt.Fprintf(logOut, "Replaced %s, a copy of %s, by %s (line %d)\n", alias.Name, id.Name, id.Name, fset.Position(alias.Pos()).Line)
+			opts.recordChange(alias.Pos(), "replaced %s, a copy of %s, by %s", alias.Name, id.Name, id.Name)
+		}
+	}
+
+	for _, id := range params {
+		for _, pos := range rewriteLoopCalls(d.Body, id) {
+			fmt.Fprintf(logOut, "Rewrote for %s.Loop() of line %d as a loop bounded by %s.N\n", id.Name, fset.Position(pos).Line, id.Name)
+			opts.recordChange(pos, "rewrote for %s.Loop() as a loop bounded by %s.N", id.Name, id.Name)
+		}
+	}
+
+	for _, pos := range unwrapFirstRunChecks(d.Body, testingBIdent) {
+		fmt.Fprintf(logOut, "Running the body of if %s.N == 1 of line %d unconditionally, once, like go test does\n", testingBIdent.Name, fset.Position(pos).Line)
+		opts.recordChange(pos, "ran the body of if %s.N == 1 unconditionally, once", testingBIdent.Name)
+	}
+	for _, id := range params {
+		for _, op := range findNComparisons(d.Body, id) {
+			var expr strings.Builder
+			printer.Fprint(&expr, fset, op)
+			fmt.Fprintf(logOut, "Warning: %s:%d: %s depends on the number of iterations of the only run of the binary, not on the successive runs of go test, the first of which has %s.N == 1\n", loc.file, fset.Position(op.Pos()).Line, expr.String(), id.Name)
+		}
+	}
+
+	if callsResetTimer(d.Body, params) {
+		if opts.timerLabels {
+			d.Body.List = append([]ast.Stmt{&ast.ExprStmt{
+				X: &ast.CallExpr{Fun: opts.hookRef(d.Body.Lbrace, timerSetupHook)},
+			}}, d.Body.List...)
+		} else {
+			fmt.Fprintf(logOut, "Note: %s calls ResetTimer, but the binary runs its setup too, which shows up in profiles; with -timer-labels, go tool pprof -tagfocus=gobb=timed leaves it out\n", loc.name)
+		}
+	}
+
+	helpers, err := findBenchHelpers(fset, pkgDir, fileAst.Name.Name)
+	if err != nil {
+		return err
+	}
+	var helperNames []string
+	helperCalls := map[*ast.CallExpr]bool{}
+	for _, id := range params {
+		names, calls := redirectHelperCalls(d.Body, id, helpers, opts.stubType != "")
+		helperNames = append(helperNames, names...)
+		for call := range calls {
+			helperCalls[call] = true
+		}
+	}
+
+	for i, id := range params {
+		for _, pos := range findGoroutineLoops(d.Body, id) {
+			fmt.Fprintf(logOut, "Warning: %s:%d: %s starts goroutines in a loop bounded by %s.N; large numbers of iterations start as many goroutines\n", loc.file, fset.Position(pos).Line, loc.name, id.Name)
+		}
+		for _, site := range findProportionalAllocs(fileAst, d.Body, id) {
+			fmt.Fprintf(logOut, "Warning: %s:%d: %s allocates in proportion to %s.N; large numbers of iterations allocate as much memory\n", loc.file, fset.Position(site.pos).Line, site.fun, id.Name)
+		}
+
+		if call := findAlteringCall(d.Body, id); opts.strict && opts.stubType == "" && call != nil {
+			method := call.Fun.(*ast.SelectorExpr).Sel.Name
+			return errors.New(withSnippet(fmt.Sprintf("%s:%d: %s calls %s.%s, which the rewrite cannot keep: %s; rejected by -strict", loc.file, fset.Position(call.Pos()).Line, loc.name, id.Name, method, alteringMethods[method]), fset, call.Pos()))
+		}
+
+		if call := findMethodCall(d.Body, id, "Name"); call != nil && names[i] == "" {
+			return errors.New(withSnippet(fmt.Sprintf("%s:%d: %s calls %s.Name, but %s is the parameter of a sub-benchmark whose name is not a constant string; this is not supported", loc.file, fset.Position(call.Pos()).Line, loc.name, id.Name, id.Name), fset, call.Pos()))
+		}
+
+		idOpts := opts
+		idOpts.benchName = names[i]
+		d.Body = removeReferencesToIdentifier(fset, id, d.Body, idOpts).(*ast.BlockStmt)
+	}
+
+	if opts.stubType != "" {
+		for i, id := range params {
+			// b := GoBBNewB("BenchmarkX")
+			// defer b.GoBBDone()
+			stub := &ast.AssignStmt{
+				Lhs: []ast.Expr{ast.NewIdent(id.Name)},
+				Tok: token.DEFINE,
+				Rhs: []ast.Expr{&ast.CallExpr{
+					Fun:  opts.hookRef(token.NoPos, stubConstructor),
+					Args: []ast.Expr{&ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(names[i])}},
+				}},
+			}
+			done := &ast.DeferStmt{Call: &ast.CallExpr{
+				Fun: &ast.SelectorExpr{X: ast.NewIdent(id.Name), Sel: ast.NewIdent(stubDone)},
+			}}
+			blocks[i].List = append([]ast.Stmt{stub, done}, blocks[i].List...)
+		}
+	}
+
+	if opts.stripRuntimeHints {
+		d.Body = removeRuntimeHints(fset, fileAst, d.Body, opts).(*ast.BlockStmt)
+	}
+	replaceTestingTypes(fileAst, d.Body, opts)
+
+	if pos := findTestingBTypeRef(fileAst, d.Body); pos.IsValid() {
+		if isFuncLitParam(d.Body, pos) {
+			id := params[len(params)-1].Name
+			return errors.New(withSnippet(fmt.Sprintf("%s:%d: %s declares a function taking a *testing.B, such as a sub-benchmark given to %s.Run by name; without -inline-stubs, only the sub-benchmarks run by %s.Run(\"name\", func(%s *testing.B) {...}) are supported, which -n %s/NAME selects", loc.file, fset.Position(pos).Line, loc.name, id, id, id, name), fset, pos))
+		}
+		return errors.New(withSnippet(fmt.Sprintf("%s:%d: %s refers to the testing.B type, which cannot be used outside of the testing harness; this pattern is not supported", loc.file, fset.Position(pos).Line, loc.name), fset, pos))
+	}
+
+	wrappers, err := findTestingBWrappers(pkgDir)
+	if err != nil {
+		return err
+	}
+	for _, id := range params {
+		if sel := findUnknownMethod(d.Body, id); opts.stubType != "" && sel != nil {
+			return errors.New(withSnippet(fmt.Sprintf("%s:%d: %s uses %s.%s, which %s does not provide; this is not supported", loc.file, fset.Position(sel.Pos()).Line, loc.name, id.Name, sel.Sel.Name, opts.stubType), fset, sel.Pos()))
+		}
+		if pos, wrapper := findRemainingRef(d.Body, id, wrappers, helperCalls, opts.stubType != ""); pos.IsValid() {
+			line := fset.Position(pos).Line
+			if wrapper != "" {
+				return errors.New(withSnippet(fmt.Sprintf("%s:%d: %s wraps %s in %s, a type holding a testing.B; benchmarks using such wrappers are not supported", loc.file, line, loc.name, id.Name, wrapper), fset, pos))
+			}
+			if call := findMethodValue(d.Body, pos); call != nil {
+				method := call.Fun.(*ast.SelectorExpr).Sel.Name
+				return errors.New(withSnippet(fmt.Sprintf("%s:%d: %s uses the result of %s.%s, which the rewrite has no replacement for; %s", loc.file, line, loc.name, id.Name, method, unsupportedMethodValue(method)), fset, pos))
+			}
+			if findTypeAssertion(d.Body, pos) != nil {
+				return errors.New(withSnippet(fmt.Sprintf("%s:%d: %s asserts the dynamic type of %s, in a type assertion or a type switch; %s is removed or replaced by the rewrite, so the assertion would not see a testing.B; this is not supported", loc.file, line, loc.name, id.Name, id.Name), fset, pos))
+			}
+			if as := findDestructuringCall(d.Body, pos); as != nil {
+				return errors.New(withSnippet(fmt.Sprintf("%s:%d: %s assigns or passes %s in a multi-value assignment from a function call; the values it returns, which may be or wrap the testing.B, cannot be tracked without type information; this is not supported", loc.file, line, loc.name, id.Name), fset, pos))
+			}
+			return errors.New(withSnippet(fmt.Sprintf("%s:%d: %s uses %s other than through %s.N or a method call (for example by passing it to a function); this is not supported", loc.file, line, loc.name, id.Name, id.Name), fset, pos))
+		}
+	}
+
+	err = rewriteHelpers(fset, pkgDir, fileAst.Name.Name, loc.name, helperNames, helpers, wrappers, opts)
+	if err != nil {
+		return err
+	}
+
+	if opts.rename != "" {
+		pos, err := findPackageDecl(pkgDir, opts.rename)
+		if err != nil {
+			return err
+		}
+		if pos.IsValid() {
+			return fmt.Errorf("%s:%d: cannot rename %s to %s, which is already declared at %s", loc.file, fset.Position(d.Name.Pos()).Line, loc.name, opts.rename, pos)
+		}
+		d.Name.Name = opts.rename
+	}
+
+	// Add go:noinline comment. The printer only emits comments that are
+	// part of the file and positioned, so a new doc comment group is
+	// registered right before the function.
+	noinline := &ast.Comment{
+		Slash: d.Pos() - 1,
+		Text:  "//go:noinline",
+	}
+	if d.Doc == nil {
+		d.Doc = &ast.CommentGroup{List: []*ast.Comment{noinline}}
+		addCommentGroup(fileAst, d.Doc)
+	} else {
+		d.Doc.List = append(d.Doc.List, noinline)
+	}
+
+	// The benchmark may have been the only user of the testing package in
+	// the file.
+	removeTestingImport(fset, fileAst)
+
+	// Write out modified file
+	out, err := os.OpenFile(filePath, os.O_RDWR|os.O_TRUNC, 0755)
+	if err != nil {
+		die("Could not open file %s for writing: %s", filePath, err)
+	}
+	defer out.Close()
+	err = format.Node(out, fset, fileAst)
+	if err != nil {
+		die("Could not format modified source: %s", err)
+	}
+
+	return nil
+}
+
+// removeTestingImport removes the import of the testing package from f if
+// nothing in f refers to it anymore.
+func removeTestingImport(fset *token.FileSet, f *ast.File) {
+	for _, spec := range f.Imports {
+		if strings.Trim(spec.Path.Value, `"`) != "testing" || astutil.UsesImport(f, "testing") {
+			continue
+		}
+		name := ""
+		if spec.Name != nil {
+			name = spec.Name.Name
+		}
+		astutil.DeleteNamedImport(fset, f, name, "testing")
+		return
+	}
+}
+
+// addCommentGroup inserts g in the comments of f, keeping them sorted by
+// position.
+func addCommentGroup(f *ast.File, g *ast.CommentGroup) {
+	i := sort.Search(len(f.Comments), func(i int) bool {
+		return f.Comments[i].Pos() >= g.Pos()
+	})
+	f.Comments = append(f.Comments, nil)
+	copy(f.Comments[i+1:], f.Comments[i:])
+	f.Comments[i] = g
+}
+
+func printNodeCode(fset *token.FileSet, node ast.Node) {
+	if node == nil {
+		return
+	}
+	var buf bytes.Buffer
+	err := format.Node(&buf, fset, node)
+	if err != nil {
+		log.Println("warning: printNodeCode:", err)
+	}
+
+	fmt.Fprintln(logOut, buf.String())
+}
+
+// Very not complete, also probably not sound either.
+//
+// - Removes calls of the form b.X(?)
+// - Replace b.N by opts.iterationsVar
+// - Wrap the condition of for ?; ? < b.?; ? {} in opts.tickFunc()
+// - With opts.keepLogs, replace b.Log and b.Logf by their logMethods hooks
+// - With opts.timerLabels, replace the timer methods by their timerMethods
+// hooks
+// - Replace b.RunParallel and b.SetParallelism by their parallelMethods
+// hooks, and the methods reporting failures by their failMethods hooks
+// - With opts.stubType, only the latter (and opts.stripBookkeeping removes
+// the calls of bookkeepingMethods)
+//
+// TODO: do all of this better. It's also where the main complexity of this problem lies.
+func removeReferencesToIdentifier(fset *token.FileSet, id *ast.Ident, root ast.Node, opts rewriteOptions) ast.Node {
+	depth := 0
+	deleteMe := false
+
+	return astutil.Apply(root, func(c *astutil.Cursor) bool {
+		node := c.Node()
+
+		// fmt.Println("---------------------------------------------")
+		// fmt.Println("----[", c.Name())
+		// fmt.Println("[[[[[", depth)
+		// fmt.Printf("%T, %+v\n", node, node)
+		// printNodeCode(fset, node)
+		// fmt.Println("---------------------------------------------")
+
+		switch v := node.(type) {
+		case *ast.CallExpr:
+			f := v.Fun
+			sel, ok := f.(*ast.SelectorExpr)
+			if ok {
+				expr := sel.X
+				ident, ok := expr.(*ast.Ident)
+				hook := ""
+				switch {
+				case !ok || ident.Obj != id.Obj || opts.stubType != "":
+				case opts.keepLogs && logMethods[sel.Sel.Name] != "":
+					hook = logMethods[sel.Sel.Name]
+				case opts.timerLabels && timerMethods[sel.Sel.Name] != "":
+					hook = timerMethods[sel.Sel.Name]
+				case parallelMethods[sel.Sel.Name] != "":
+					hook = parallelMethods[sel.Sel.Name]
+				case failMethods[sel.Sel.Name] != "":
+					hook = failMethods[sel.Sel.Name]
+				}
+				if hook != "" {
+					opts.recordChange(v.Pos(), "replaced %s by a call of %s", methodCallString(sel, v), hook)
+					v.Fun = opts.hookRef(sel.Pos(), hook)
+					break
+				}
+				// A call used as a value, rather than as a
+				// statement, cannot be removed: replace it, or
+				// leave it to be reported.
+				if ok && ident.Obj == id.Obj && opts.stubType == "" && !isCallStmt(c.Parent()) {
+					if x := opts.methodValue(v.Pos(), sel.Sel.Name); x != nil {
+						var s strings.Builder
+						printer.Fprint(&s, token.NewFileSet(), x)
+						opts.recordChange(v.Pos(), "replaced %s by %s", methodCallString(sel, v), s.String())
+						c.Replace(x)
+						return false
+					}
+					break
+				}
+				if ok && ident.Obj == id.Obj && (opts.stubType == "" || opts.stripBookkeeping && bookkeepingMethods[sel.Sel.Name]) {
+					opts.recordChange(v.Pos(), "removed %s", methodCallString(sel, v))
+					deleteMe = true
+					return false
+				}
+			}
+		case *ast.ForStmt:
+			if opts.tickFunc != "" && isBenchLoop(v, id) {
+				// The condition is evaluated before every iteration,
+				// including after a continue, and once more when
+				// the loop ends.
+				v.Cond = &ast.CallExpr{
+					Fun:  opts.hookRef(v.Cond.Pos(), opts.tickFunc),
+					Args: []ast.Expr{v.Cond},
+				}
+			}
+		case *ast.RangeStmt:
+			if opts.tickFunc != "" && isBenchRange(v, id) {
+				// No condition: tick at the start of every
+				// iteration, and once the loop ends, after it
+				// or after the statement labeling it.
+				v.Body.List = append([]ast.Stmt{tickStmt(v.Body.Lbrace, opts, true)}, v.Body.List...)
+				if c.Index() >= 0 {
+					c.InsertAfter(tickStmt(v.Body.Rbrace, opts, false))
+				}
+			}
+		case *ast.LabeledStmt:
+			if r, ok := v.Stmt.(*ast.RangeStmt); ok && opts.tickFunc != "" && isBenchRange(r, id) && c.Index() >= 0 {
+				c.InsertAfter(tickStmt(r.Body.Rbrace, opts, false))
+			}
+		case *ast.SelectorExpr:
+			ident, ok := v.X.(*ast.Ident)
+			if ok && ident.Obj == id.Obj && v.Sel.Name == "N" && opts.stubType == "" {
+				c.Replace(opts.hookRef(v.Pos(), opts.iterationsVar))
+			}
+		}
+
+		depth++
+		return true
+	}, func(c *astutil.Cursor) bool {
+		depth--
+		if deleteMe && c.Index() >= 0 {
+			c.Delete()
+			deleteMe = false
+			return true
+		}
+		// Do not leave an if statement behind once the calls it
+		// guarded are removed, as in if debug { b.Log(x) }.
+		if v, ok := c.Node().(*ast.IfStmt); ok && c.Index() >= 0 && v.Init == nil && v.Else == nil && len(v.Body.List) == 0 && isPureExpr(v.Cond) {
+			c.Delete()
+		}
+		return true
+	})
+}
+
+// isCallStmt reports whether n is a statement made of a call only.
+func isCallStmt(n ast.Node) bool {
+	switch n.(type) {
+	case *ast.ExprStmt, *ast.GoStmt, *ast.DeferStmt:
+		return true
+	}
+	return false
+}
+
+// isPureExpr reports whether evaluating x has no side effect: it is made of
+// identifiers, selectors and literals only.
+func isPureExpr(x ast.Expr) bool {
+	switch v := x.(type) {
+	case *ast.Ident, *ast.BasicLit:
+		return true
+	case *ast.SelectorExpr:
+		return isPureExpr(v.X)
+	case *ast.ParenExpr:
+		return isPureExpr(v.X)
+	case *ast.UnaryExpr:
+		return v.Op != token.ARROW && isPureExpr(v.X)
+	case *ast.BinaryExpr:
+		return isPureExpr(v.X) && isPureExpr(v.Y)
+	}
+	return false
+}
+
+// removeRuntimeHints deletes the statements of root that only call one of
+// the runtimeHints, and the import of runtime if it is not used anymore.
+func removeRuntimeHints(fset *token.FileSet, f *ast.File, root ast.Node, opts rewriteOptions) ast.Node {
+	name := importName(f, "runtime")
+	if name == "" || name == "_" {
+		return root
+	}
+
+	root = astutil.Apply(root, func(c *astutil.Cursor) bool {
+		stmt, ok := c.Node().(*ast.ExprStmt)
+		if !ok || c.Index() < 0 {
+			return true
+		}
+		call, ok := stmt.X.(*ast.CallExpr)
+		if !ok {
+			return true
+		}
+		sel, ok := call.Fun.(*ast.SelectorExpr)
+		if !ok || !runtimeHints[sel.Sel.Name] {
+			return true
+		}
+		if ident, ok := sel.X.(*ast.Ident); ok && ident.Name == name && ident.Obj == nil {
+			fmt.Fprintf(logOut, "Removed runtime.%s() (line %d)\n", sel.Sel.Name, fset.Position(stmt.Pos()).Line)
+			opts.recordChange(stmt.Pos(), "removed runtime.%s()", sel.Sel.Name)
+			c.Delete()
+			return false
+		}
+		return true
+	}, nil)
+
+	if !astutil.UsesImport(f, "runtime") {
+		astutil.DeleteNamedImport(fset, f, importSpecName(f, "runtime"), "runtime")
+	}
+	return root
+}
+
+// importSpecName returns the explicit name of the import of importPath in
+// f, or an empty string.
+func importSpecName(f *ast.File, importPath string) string {
+	for _, spec := range f.Imports {
+		if strings.Trim(spec.Path.Value, `"`) == importPath && spec.Name != nil {
+			return spec.Name.Name
+		}
+	}
+	return ""
+}
+
+// removePackageRefs deletes the package-level var declarations of the Go
+// files of dir that only exist to refer to one of the rewritten benchmark
+// functions, such as var _ = BenchmarkMe: once the *testing.B parameter is
+// removed, their type would not match anymore. It returns an error for the
+// declarations of named variables, which may be used elsewhere.
+func removePackageRefs(dir string, funcs map[string]bool) error {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, x := range files {
+		if x.IsDir() || !strings.HasSuffix(x.Name(), ".go") {
+			continue
+		}
+		filePath := path.Join(dir, x.Name())
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, filePath, nil, parser.ParseComments)
+		if err != nil {
+			return err
+		}
+
+		changed := false
+		decls := f.Decls[:0]
+		for _, decl := range f.Decls {
+			gd, ok := decl.(*ast.GenDecl)
+			if !ok || gd.Tok != token.VAR {
+				decls = append(decls, decl)
+				continue
+			}
+			specs := gd.Specs[:0]
+			for _, spec := range gd.Specs {
+				vs := spec.(*ast.ValueSpec)
+				name := refersToFunc(vs, funcs)
+				if name == "" {
+					specs = append(specs, spec)
+					continue
+				}
+				line := fset.Position(vs.Pos()).Line
+				for _, id := range vs.Names {
+					if id.Name != "_" {
+						return errors.New(withSnippet(fmt.Sprintf("%s:%d: package-level variable %s refers to %s, whose signature is changed by the rewrite; this is not supported", x.Name(), line, id.Name, name), fset, vs.Pos()))
+					}
+				}
+				fmt.Fprintf(logOut, "Removed package-level reference to %s (%s:%d)\n", name, x.Name(), line)
+				changed = true
+			}
+			gd.Specs = specs
+			if len(specs) > 0 {
+				decls = append(decls, decl)
+			}
+		}
+		if !changed {
+			continue
+		}
+		f.Decls = decls
+		if !astutil.UsesImport(f, "testing") {
+			astutil.DeleteNamedImport(fset, f, importSpecName(f, "testing"), "testing")
+		}
+
+		var buf bytes.Buffer
+		err = format.Node(&buf, fset, f)
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(filePath, buf.Bytes(), 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refersToFunc returns the name of the first function of funcs that the
+// values of vs refer to, or an empty string.
+func refersToFunc(vs *ast.ValueSpec, funcs map[string]bool) string {
+	name := ""
+	var visit func(n ast.Node) bool
+	visit = func(n ast.Node) bool {
+		if name != "" {
+			return false
+		}
+		switch v := n.(type) {
+		case *ast.SelectorExpr:
+			// The selected name belongs to another package or type.
+			ast.Inspect(v.X, visit)
+			return false
+		case *ast.Ident:
+			if funcs[v.Name] && (v.Obj == nil || v.Obj.Kind == ast.Fun) {
+				name = v.Name
+			}
+		}
+		return true
+	}
+	for _, v := range vs.Values {
+		ast.Inspect(v, visit)
+	}
+	return name
+}
+
+// inlineSingleRun replaces the statement b.Run(name, func(b *testing.B) {...})
+// of body by the body of the function literal, if it is the only call of the
+// Run method of id in body. A name that is not a literal is kept evaluated,
+// with _ = name. It returns the parameter of the literal and its body, or
+// nil.
+func inlineSingleRun(body *ast.BlockStmt, id *ast.Ident) (*ast.Ident, *ast.BlockStmt) {
+	runs := 0
+	ast.Inspect(body, func(n ast.Node) bool {
+		if call, ok := n.(*ast.CallExpr); ok && isMethodCall(call, id, "Run") {
+			runs++
+		}
+		return true
+	})
+	if runs != 1 {
+		return nil, nil
+	}
+	for i, stmt := range body.List {
+		es, ok := stmt.(*ast.ExprStmt)
+		if !ok {
+			continue
+		}
+		call, ok := es.X.(*ast.CallExpr)
+		if !ok || !isMethodCall(call, id, "Run") || len(call.Args) != 2 {
+			continue
+		}
+		lit, ok := call.Args[1].(*ast.FuncLit)
+		if !ok || lit.Type.Params.NumFields() != 1 || len(lit.Type.Params.List[0].Names) != 1 {
+			return nil, nil
+		}
+		if _, ok := call.Args[0].(*ast.BasicLit); !ok {
+			keep := &ast.AssignStmt{
+				Lhs:    []ast.Expr{&ast.Ident{NamePos: call.Pos(), Name: "_"}},
+				TokPos: call.Pos(),
+				Tok:    token.ASSIGN,
+				Rhs:    []ast.Expr{call.Args[0]},
+			}
+			lit.Body.List = append([]ast.Stmt{keep}, lit.Body.List...)
+		}
+		body.List[i] = lit.Body
+		return lit.Type.Params.List[0].Names[0], lit.Body
+	}
+	return nil, nil
+}
+
+// selectSubBenchmark replaces the statement of body running the sub-benchmark
+// of id whose name matches re, id.Run("name", func(b *testing.B) {...}), by
+// the body of the function, and removes the ones running the others. It
+// returns the parameter of the function, its body and the name of the
+// sub-benchmark, as go test reports it. Exactly one sub-benchmark must match,
+// and all must have a constant name.
+func selectSubBenchmark(fset *token.FileSet, loc fnLoc, body *ast.BlockStmt, id *ast.Ident, re *regexp.Regexp) (*ast.Ident, *ast.BlockStmt, string, error) {
+	var names []string
+	var errPos token.Pos
+	var errMsg string
+	var inner *ast.Ident
+	var block *ast.BlockStmt
+	var selected string
+	astutil.Apply(body, func(c *astutil.Cursor) bool {
+		if errPos.IsValid() {
+			return false
+		}
+		es, ok := c.Node().(*ast.ExprStmt)
+		if !ok {
+			return true
+		}
+		call, ok := es.X.(*ast.CallExpr)
+		if !ok || !isMethodCall(call, id, "Run") || len(call.Args) != 2 || c.Index() < 0 {
+			return true
+		}
+		lit, ok := call.Args[0].(*ast.BasicLit)
+		var name string
+		if ok && lit.Kind == token.STRING {
+			name, _ = strconv.Unquote(lit.Value)
+		}
+		if name == "" {
+			errPos, errMsg = call.Args[0].Pos(), "names a sub-benchmark with an expression that is not a constant string; only sub-benchmarks named by a string literal can be selected"
+			return false
+		}
+		// Like go test does.
+		name = strings.ReplaceAll(name, " ", "_")
+		names = append(names, name)
+		if !re.MatchString(name) {
+			if captured := capturedVars(body, call); len(captured) > 0 {
+				// Keep the variables only the removed
+				// sub-benchmark used in use.
+				blanks := make([]ast.Expr, len(captured))
+				for i := range blanks {
+					blanks[i] = &ast.Ident{NamePos: call.Pos(), Name: "_"}
+				}
+				c.Replace(&ast.AssignStmt{Lhs: blanks, TokPos: call.Pos(), Tok: token.ASSIGN, Rhs: captured})
+			} else {
+				c.Delete()
+			}
+			return false
+		}
+		fn, ok := call.Args[1].(*ast.FuncLit)
+		if !ok || fn.Type.Params.NumFields() != 1 || len(fn.Type.Params.List[0].Names) != 1 {
+			errPos, errMsg = call.Args[1].Pos(), fmt.Sprintf("runs the sub-benchmark %s with a function that is not a literal with a named parameter; this is not supported", name)
+			return false
+		}
+		if inner != nil {
+			errPos, errMsg = call.Pos(), fmt.Sprintf("has several sub-benchmarks matching %s: %s and %s", re, selected, name)
+			return false
+		}
+		inner, block, selected = fn.Type.Params.List[0].Names[0], fn.Body, name
+		c.Replace(fn.Body)
+		return false
+	}, nil)
+	if errPos.IsValid() {
+		return nil, nil, "", errors.New(withSnippet(fmt.Sprintf("%s:%d: %s %s", loc.file, fset.Position(errPos).Line, loc.name, errMsg), fset, errPos))
+	}
+	if inner == nil {
+		if len(names) == 0 {
+			return nil, nil, "", fmt.Errorf("%s: %s has no sub-benchmark run by a statement %s.Run(\"name\", func(...) {...})", loc.file, loc.name, id.Name)
+		}
+		return nil, nil, "", fmt.Errorf("%s: %s has no sub-benchmark matching %s among %s", loc.file, loc.name, re, strings.Join(names, ", "))
+	}
+	return inner, block, selected, nil
+}
+
+// capturedVars returns identifiers referring to the variables that n uses
+// and that are declared before it in body, once each.
+func capturedVars(body *ast.BlockStmt, n ast.Node) []ast.Expr {
+	var vars []ast.Expr
+	seen := map[*ast.Object]bool{}
+	ast.Inspect(n, func(x ast.Node) bool {
+		id, ok := x.(*ast.Ident)
+		if !ok || id.Obj == nil || id.Obj.Kind != ast.Var || seen[id.Obj] {
+			return true
+		}
+		decl, ok := id.Obj.Decl.(ast.Node)
+		if ok && decl.Pos() >= body.Pos() && decl.End() <= n.Pos() {
+			seen[id.Obj] = true
+			vars = append(vars, &ast.Ident{NamePos: n.Pos(), Name: id.Name, Obj: id.Obj})
+		}
+		return true
+	})
+	return vars
+}
+
+// subBenchmarkNames returns the names of the sub-benchmarks body runs with
+// id.Run, and the position of the first call, if any. Names that are not
+// string literals are reported as a "?".
+func subBenchmarkNames(body *ast.BlockStmt, id *ast.Ident) ([]string, token.Pos) {
+	var names []string
+	pos := token.NoPos
+	ast.Inspect(body, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok || !isMethodCall(call, id, "Run") || len(call.Args) != 2 {
+			return true
+		}
+		if !pos.IsValid() {
+			pos = call.Pos()
+		}
+		name := "?"
+		if lit, ok := call.Args[0].(*ast.BasicLit); ok && lit.Kind == token.STRING {
+			name, _ = strconv.Unquote(lit.Value)
+			name = strings.ReplaceAll(name, " ", "_")
+		}
+		names = append(names, name)
+		return true
+	})
+	return names, pos
+}
+
+// isMethodCall returns true if call is id.name(...).
+func isMethodCall(call *ast.CallExpr, id *ast.Ident, name string) bool {
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok || sel.Sel.Name != name {
+		return false
+	}
+	ident, ok := sel.X.(*ast.Ident)
+	return ok && ident.Obj == id.Obj
+}
+
+// findMethodCall returns the first call of root of the method name of id, or
+// nil.
+func findMethodCall(root ast.Node, id *ast.Ident, name string) *ast.CallExpr {
+	var found *ast.CallExpr
+	ast.Inspect(root, func(n ast.Node) bool {
+		if call, ok := n.(*ast.CallExpr); ok && found == nil && isMethodCall(call, id, name) {
+			found = call
+		}
+		return found == nil
+	})
+	return found
+}
+
+// resolveAliases replaces the local variables of body that are plain copies
+// of id (bp := b, var bp = b), directly or through other copies, by id, and
+// removes their declarations. It returns the identifiers of the declared
+// variables. Variables assigned again, and all copies if id is shadowed in
+// body, are left alone.
+func resolveAliases(body *ast.BlockStmt, id *ast.Ident) []*ast.Ident {
+	shadowed := false
+	ast.Inspect(body, func(n ast.Node) bool {
+		if v, ok := n.(*ast.Ident); ok && v.Name == id.Name && v.Obj != nil && v.Obj != id.Obj {
+			shadowed = true
+		}
+		return !shadowed
+	})
+	if shadowed {
+		return nil
+	}
+
+	var aliases []*ast.Ident
+	for {
+		alias, decl := findAlias(body, id)
+		if alias == nil {
+			return aliases
+		}
+		aliases = append(aliases, alias)
+		astutil.Apply(body, func(c *astutil.Cursor) bool {
+			switch v := c.Node().(type) {
+			case ast.Stmt:
+				if v == decl {
+					c.Delete()
+					return false
+				}
+			case *ast.Ident:
+				if v.Obj == alias.Obj {
+					c.Replace(&ast.Ident{NamePos: v.NamePos, Name: id.Name, Obj: id.Obj})
+				}
+			}
+			return true
+		}, nil)
+	}
+}
+
+// findAlias returns the first variable of body declared as a copy of id by a
+// statement of a block, and the statement, or nil. The variable must not be
+// assigned anywhere else.
+func findAlias(body *ast.BlockStmt, id *ast.Ident) (*ast.Ident, ast.Stmt) {
+	isID := func(x ast.Expr) bool {
+		v, ok := x.(*ast.Ident)
+		return ok && v.Obj == id.Obj
+	}
+	// copied returns the variable stmt declares as a copy of id, or nil.
+	copied := func(stmt ast.Stmt) *ast.Ident {
+		switch v := stmt.(type) {
+		case *ast.AssignStmt:
+			if v.Tok == token.DEFINE && len(v.Lhs) == 1 && len(v.Rhs) == 1 && isID(v.Rhs[0]) {
+				if lhs, ok := v.Lhs[0].(*ast.Ident); ok && lhs.Name != "_" && lhs.Obj != nil {
+					return lhs
+				}
+			}
+		case *ast.DeclStmt:
+			gd, ok := v.Decl.(*ast.GenDecl)
+			if !ok || gd.Tok != token.VAR || len(gd.Specs) != 1 {
+				break
+			}
+			spec := gd.Specs[0].(*ast.ValueSpec)
+			if spec.Type == nil && len(spec.Names) == 1 && len(spec.Values) == 1 && isID(spec.Values[0]) && spec.Names[0].Name != "_" {
+				return spec.Names[0]
+			}
+		}
+		return nil
+	}
+
+	var alias *ast.Ident
+	var decl ast.Stmt
+	ast.Inspect(body, func(n ast.Node) bool {
+		if alias != nil {
+			return false
+		}
+		var list []ast.Stmt
+		switch v := n.(type) {
+		case *ast.BlockStmt:
+			list = v.List
+		case *ast.CaseClause:
+			list = v.Body
+		case *ast.CommClause:
+			list = v.Body
+		}
+		for _, stmt := range list {
+			if x := copied(stmt); x != nil && !isReassigned(body, x, stmt) {
+				alias, decl = x, stmt
+				break
+			}
+		}
+		return alias == nil
+	})
+	return alias, decl
+}
+
+// isReassigned reports whether the variable x, declared by decl, is assigned
+// by another statement of body, or has its address taken.
+func isReassigned(body *ast.BlockStmt, x *ast.Ident, decl ast.Stmt) bool {
+	found := false
+	ast.Inspect(body, func(n ast.Node) bool {
+		switch v := n.(type) {
+		case *ast.AssignStmt:
+			if v == decl {
+				return true
+			}
+			for _, lhs := range v.Lhs {
+				if y, ok := lhs.(*ast.Ident); ok && y.Obj == x.Obj {
+					found = true
+				}
+			}
+		case *ast.UnaryExpr:
+			if y, ok := v.X.(*ast.Ident); ok && v.Op == token.AND && y.Obj == x.Obj {
+				found = true
+			}
+		}
+		return !found
+	})
+	return found
+}
+
+// findDestructuringCall returns the statement of root of the form
+// x, y := f(...) in which pos is one of the assigned variables or of the
+// arguments of the call, or nil.
+func findDestructuringCall(root ast.Node, pos token.Pos) *ast.AssignStmt {
+	var found *ast.AssignStmt
+	ast.Inspect(root, func(n ast.Node) bool {
+		if found != nil {
+			return false
+		}
+		as, ok := n.(*ast.AssignStmt)
+		if !ok || len(as.Lhs) < 2 || len(as.Rhs) != 1 {
+			return true
+		}
+		call, ok := as.Rhs[0].(*ast.CallExpr)
+		if !ok {
+			return true
+		}
+		for _, e := range append(as.Lhs[:len(as.Lhs):len(as.Lhs)], call.Args...) {
+			if e.Pos() == pos {
+				found = as
+			}
+		}
+		return true
+	})
+	return found
+}
+
+// findMethodValue returns the call of root whose function is the method of
+// the operand at pos, or nil.
+func findMethodValue(root ast.Node, pos token.Pos) *ast.CallExpr {
+	var found *ast.CallExpr
+	ast.Inspect(root, func(n ast.Node) bool {
+		if call, ok := n.(*ast.CallExpr); ok && found == nil {
+			if sel, ok := call.Fun.(*ast.SelectorExpr); ok && sel.X.Pos() == pos {
+				found = call
+			}
+		}
+		return found == nil
+	})
+	return found
+}
+
+// findTypeAssertion returns the type assertion of root, possibly the one of a
+// type switch, whose operand is at pos, directly or converted to an interface
+// type (any(b).(type)), or nil.
+func findTypeAssertion(root ast.Node, pos token.Pos) *ast.TypeAssertExpr {
+	var found *ast.TypeAssertExpr
+	ast.Inspect(root, func(n ast.Node) bool {
+		ta, ok := n.(*ast.TypeAssertExpr)
+		if !ok || found != nil {
+			return found == nil
+		}
+		x := astutil.Unparen(ta.X)
+		if call, ok := x.(*ast.CallExpr); ok && len(call.Args) == 1 && isInterfaceType(call.Fun) {
+			x = astutil.Unparen(call.Args[0])
+		}
+		if x.Pos() == pos {
+			found = ta
+		}
+		return true
+	})
+	return found
+}
+
+// isInterfaceType reports whether x is an interface type literal or any.
+func isInterfaceType(x ast.Expr) bool {
+	switch v := astutil.Unparen(x).(type) {
+	case *ast.InterfaceType:
+		return true
+	case *ast.Ident:
+		return v.Name == "any" && v.Obj == nil
+	}
+	return false
+}
+
+// callsResetTimer reports whether root calls the ResetTimer method of one of
+// ids.
+func callsResetTimer(root ast.Node, ids []*ast.Ident) bool {
+	found := false
+	ast.Inspect(root, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok {
+			return !found
+		}
+		sel, ok := call.Fun.(*ast.SelectorExpr)
+		if !ok || sel.Sel.Name != "ResetTimer" {
+			return !found
+		}
+		if x, ok := sel.X.(*ast.Ident); ok {
+			for _, id := range ids {
+				found = found || x.Obj == id.Obj
+			}
+		}
+		return !found
+	})
+	return found
+}
+
+// nTracker tracks the local variables derived from id.N (workers := b.N /
+// batch) in the nodes it visits, in source order.
+type nTracker struct {
+	id      *ast.Ident
+	derived map[*ast.Object]bool
+}
+
+func newNTracker(id *ast.Ident) *nTracker {
+	return &nTracker{id: id, derived: map[*ast.Object]bool{}}
+}
+
+// visit records the variables n derives from id.N, if it is an assignment or
+// a declaration.
+func (t *nTracker) visit(n ast.Node) {
+	switch v := n.(type) {
+	case *ast.AssignStmt:
+		for _, rhs := range v.Rhs {
+			if !t.dependsOnN(rhs) {
+				continue
+			}
+			for _, lhs := range v.Lhs {
+				if ident, ok := lhs.(*ast.Ident); ok && ident.Obj != nil {
+					t.derived[ident.Obj] = true
+				}
+			}
+		}
+	case *ast.ValueSpec:
+		for _, value := range v.Values {
+			if t.dependsOnN(value) {
+				for _, ident := range v.Names {
+					t.derived[ident.Obj] = true
+				}
+			}
+		}
+	}
+}
+
+// dependsOnN reports whether n refers to id.N or to a variable derived from
+// it.
+func (t *nTracker) dependsOnN(n ast.Node) bool {
+	found := false
+	ast.Inspect(n, func(n ast.Node) bool {
+		switch v := n.(type) {
+		case *ast.SelectorExpr:
+			if ident, ok := v.X.(*ast.Ident); ok && ident.Obj == t.id.Obj && v.Sel.Name == "N" {
+				found = true
+			}
+		case *ast.Ident:
+			if v.Obj != nil && t.derived[v.Obj] {
+				found = true
+			}
+		}
+		return !found
+	})
+	return found
+}
+
+// findGoroutineLoops returns the positions of the loops of root that start
+// goroutines, and whose bound depends on id.N, directly or through local
+// variables (workers := b.N / batch).
+func findGoroutineLoops(root ast.Node, id *ast.Ident) []token.Pos {
+	t := newNTracker(id)
+	startsGoroutines := func(n ast.Node) bool {
+		found := false
+		ast.Inspect(n, func(n ast.Node) bool {
+			if _, ok := n.(*ast.GoStmt); ok {
+				found = true
+			}
+			return !found
+		})
+		return found
+	}
+
+	var positions []token.Pos
+	ast.Inspect(root, func(n ast.Node) bool {
+		t.visit(n)
+		switch v := n.(type) {
+		case *ast.ForStmt:
+			if v.Cond != nil && t.dependsOnN(v.Cond) && startsGoroutines(v.Body) {
+				positions = append(positions, v.Pos())
+			}
+		case *ast.RangeStmt:
+			if t.dependsOnN(v.X) && startsGoroutines(v.Body) {
+				positions = append(positions, v.Pos())
+			}
+		}
+		return true
+	})
+	return positions
+}
+
+// repeatFuncs are the functions of the standard library, by import path,
+// whose last argument is a count of copies of the first one.
+var repeatFuncs = map[string][]string{
+	"bytes":   {"Repeat"},
+	"strings": {"Repeat"},
+}
+
+// allocSite is a call allocating memory, and the name of the function called.
+type allocSite struct {
+	pos token.Pos
+	fun string
+}
+
+// findProportionalAllocs returns the calls of root that allocate memory in
+// proportion to id.N, directly or through local variables: make of slices,
+// channels and maps, and the repeatFuncs.
+func findProportionalAllocs(f *ast.File, root ast.Node, id *ast.Ident) []allocSite {
+	repeats := map[string]string{}
+	for p, funcs := range repeatFuncs {
+		if name := importName(f, p); name != "" {
+			for _, fn := range funcs {
+				repeats[name+"."+fn] = p + "." + fn
+			}
+		}
+	}
+
+	t := newNTracker(id)
+	var sites []allocSite
+	ast.Inspect(root, func(n ast.Node) bool {
+		t.visit(n)
+		call, ok := n.(*ast.CallExpr)
+		if !ok || len(call.Args) < 2 {
+			return true
+		}
+		name := ""
+		switch fun := call.Fun.(type) {
+		case *ast.Ident:
+			if fun.Name != "make" || fun.Obj != nil {
+				return true
+			}
+			switch typ := call.Args[0].(type) {
+			case *ast.ArrayType:
+				if typ.Len == nil {
+					name = "make"
+				}
+			case *ast.ChanType, *ast.MapType:
+				name = "make"
+			}
+		case *ast.SelectorExpr:
+			if x, ok := fun.X.(*ast.Ident); ok && x.Obj == nil {
+				name = repeats[x.Name+"."+fun.Sel.Name]
+			}
+		}
+		if name == "" {
+			return true
+		}
+		for _, arg := range call.Args[1:] {
+			if t.dependsOnN(arg) {
+				sites = append(sites, allocSite{call.Pos(), name})
+				break
+			}
+		}
+		return true
+	})
+	return sites
+}
+
+// unusedName returns the first of names that no identifier of root uses, or
+// else the first one followed by the smallest number that makes it unused.
+func unusedName(root ast.Node, names ...string) string {
+	used := map[string]bool{}
+	ast.Inspect(root, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok {
+			used[id.Name] = true
+		}
+		return true
+	})
+	for _, name := range names {
+		if !used[name] {
+			return name
+		}
+	}
+	for i := 1; ; i++ {
+		if name := fmt.Sprintf("%s%d", names[0], i); !used[name] {
+			return name
+		}
+	}
+}
+
+// rewriteLoopCalls turns the loops of body of the form for id.Loop() {...},
+// the benchmark loops of Go 1.24, into for i := 0; i < id.N; i++ {...}, which
+// the rest of the rewrite handles, with a name for i that body does not use.
+// It returns the positions of the loops.
+func rewriteLoopCalls(body *ast.BlockStmt, id *ast.Ident) []token.Pos {
+	var positions []token.Pos
+	var name string
+	ast.Inspect(body, func(n ast.Node) bool {
+		v, ok := n.(*ast.ForStmt)
+		if !ok || v.Init != nil || v.Post != nil {
+			return true
+		}
+		call, ok := v.Cond.(*ast.CallExpr)
+		if !ok || len(call.Args) != 0 {
+			return true
+		}
+		sel, ok := call.Fun.(*ast.SelectorExpr)
+		if !ok || sel.Sel.Name != "Loop" {
+			return true
+		}
+		if x, ok := sel.X.(*ast.Ident); !ok || x.Obj != id.Obj {
+			return true
+		}
+		if name == "" {
+			name = unusedName(body, "i", "iter")
+		}
+		pos := v.Cond.Pos()
+		v.Init = &ast.AssignStmt{
+			Lhs:    []ast.Expr{&ast.Ident{NamePos: pos, Name: name}},
+			TokPos: pos,
+			Tok:    token.DEFINE,
+			Rhs:    []ast.Expr{&ast.BasicLit{ValuePos: pos, Kind: token.INT, Value: "0"}},
+		}
+		v.Cond = &ast.BinaryExpr{
+			X:     &ast.Ident{NamePos: pos, Name: name},
+			OpPos: pos,
+			Op:    token.LSS,
+			Y:     &ast.SelectorExpr{X: sel.X, Sel: &ast.Ident{NamePos: sel.Sel.Pos(), Name: "N"}},
+		}
+		v.Post = &ast.IncDecStmt{X: &ast.Ident{NamePos: pos, Name: name}, TokPos: pos, Tok: token.INC}
+		positions = append(positions, v.Pos())
+		return true
+	})
+	return positions
+}
+
+// unwrapFirstRunChecks replaces the statements of body of the form if id.N ==
+// 1 {...}, without init nor else, which go test runs once, on the first run
+// of the benchmark, by their block, which the binary runs once too. Only the
+// statements of body itself are considered, and not the ones whose block
+// returns or jumps, which are checks rather than setup. It returns the
+// positions of the replaced statements.
+func unwrapFirstRunChecks(body *ast.BlockStmt, id *ast.Ident) []token.Pos {
+	var positions []token.Pos
+	for i, stmt := range body.List {
+		v, ok := stmt.(*ast.IfStmt)
+		if !ok || v.Init != nil || v.Else != nil || !isFirstRunCheck(v.Cond, id) || jumps(v.Body) {
+			continue
+		}
+		positions = append(positions, v.Pos())
+		body.List[i] = v.Body
+	}
+	return positions
+}
+
+// isFirstRunCheck reports whether cond is id.N == 1 or 1 == id.N.
+func isFirstRunCheck(cond ast.Expr, id *ast.Ident) bool {
+	op, ok := cond.(*ast.BinaryExpr)
+	if !ok || op.Op != token.EQL {
+		return false
+	}
+	isOne := func(x ast.Expr) bool {
+		lit, ok := x.(*ast.BasicLit)
+		return ok && lit.Kind == token.INT && lit.Value == "1"
+	}
+	return isNSelector(op.X, id) && isOne(op.Y) || isOne(op.X) && isNSelector(op.Y, id)
+}
+
+// isNSelector reports whether x is id.N.
+func isNSelector(x ast.Expr, id *ast.Ident) bool {
+	sel, ok := x.(*ast.SelectorExpr)
+	if !ok || sel.Sel.Name != "N" {
+		return false
+	}
+	ident, ok := sel.X.(*ast.Ident)
+	return ok && ident.Obj == id.Obj
+}
+
+// jumps reports whether root contains a return or goto statement, outside of
+// function literals.
+func jumps(root ast.Node) bool {
+	found := false
+	ast.Inspect(root, func(n ast.Node) bool {
+		switch v := n.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.ReturnStmt:
+			found = true
+		case *ast.BranchStmt:
+			found = found || v.Tok == token.GOTO
+		}
+		return !found
+	})
+	return found
+}
+
+// findNComparisons returns the comparisons of id.N with a literal in root,
+// such as b.N > 1000, whose result depends on the number of iterations.
+func findNComparisons(root ast.Node, id *ast.Ident) []*ast.BinaryExpr {
+	var found []*ast.BinaryExpr
+	ast.Inspect(root, func(n ast.Node) bool {
+		op, ok := n.(*ast.BinaryExpr)
+		if !ok {
+			return true
+		}
+		switch op.Op {
+		case token.EQL, token.NEQ, token.LSS, token.LEQ, token.GTR, token.GEQ:
+		default:
+			return true
+		}
+		_, xLit := op.X.(*ast.BasicLit)
+		_, yLit := op.Y.(*ast.BasicLit)
+		if isNSelector(op.X, id) && yLit || xLit && isNSelector(op.Y, id) {
+			found = append(found, op)
+		}
+		return true
+	})
+	return found
+}
+
+// findTestingBTypeRef returns the position of the first reference to the
+// testing.B type in root, or token.NoPos.
+func findTestingBTypeRef(f *ast.File, root ast.Node) token.Pos {
+	name := importName(f, "testing")
+	if name == "" {
+		return token.NoPos
+	}
+	pos := token.NoPos
+	ast.Inspect(root, func(n ast.Node) bool {
+		if pos.IsValid() {
+			return false
+		}
+		sel, ok := n.(*ast.SelectorExpr)
+		if !ok || sel.Sel.Name != "B" {
+			return true
+		}
+		if ident, ok := sel.X.(*ast.Ident); ok && ident.Name == name && ident.Obj == nil {
+			pos = sel.Pos()
+		}
+		return true
+	})
+	return pos
+}
+
+// isFuncLitParam reports whether pos is in the parameters of a function
+// literal of root.
+func isFuncLitParam(root ast.Node, pos token.Pos) bool {
+	found := false
+	ast.Inspect(root, func(n ast.Node) bool {
+		if lit, ok := n.(*ast.FuncLit); ok && lit.Type.Params.Pos() <= pos && pos < lit.Type.Params.End() {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+// replaceTestingTypes replaces the references to the testing.PB type in root,
+// such as the parameter of the function given to b.RunParallel, by pbType,
+// and with opts.stubType, the ones to the testing.B type, such as the
+// parameters of the functions given to b.Run, by the stub type.
+func replaceTestingTypes(f *ast.File, root ast.Node, opts rewriteOptions) {
+	name := importName(f, "testing")
+	if name == "" {
+		return
+	}
+	types := map[string]string{"PB": pbType}
+	if opts.stubType != "" {
+		types["B"] = opts.stubType
+	}
+	astutil.Apply(root, func(c *astutil.Cursor) bool {
+		sel, ok := c.Node().(*ast.SelectorExpr)
+		if !ok || types[sel.Sel.Name] == "" {
+			return true
+		}
+		if ident, ok := sel.X.(*ast.Ident); ok && ident.Name == name && ident.Obj == nil {
+			c.Replace(opts.hookRef(sel.Pos(), types[sel.Sel.Name]))
+			return false
+		}
+		return true
+	}, nil)
+}
+
+// findPackageDecl returns the position, relative to dir, of the package-level
+// declaration of name in the Go files of dir, or an invalid position if there
+// is none.
+func findPackageDecl(dir, name string) (token.Position, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return token.Position{}, err
+	}
+	for _, x := range files {
+		if x.IsDir() || !strings.HasSuffix(x.Name(), ".go") {
+			continue
+		}
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, path.Join(dir, x.Name()), nil, 0)
+		if err != nil {
+			return token.Position{}, err
+		}
+		if obj := f.Scope.Lookup(name); obj != nil {
+			pos := fset.Position(obj.Pos())
+			pos.Filename = x.Name()
+			return pos, nil
+		}
+	}
+	return token.Position{}, nil
+}
+
+// findTestingBWrappers returns the struct types declared in the Go files of
+// dir that have a testing.B or *testing.B field, embedded or not, by name,
+// with the names of these fields.
+func findTestingBWrappers(dir string) (map[string][]string, error) {
+	wrappers := map[string][]string{}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, x := range files {
+		if x.IsDir() || !strings.HasSuffix(x.Name(), ".go") {
+			continue
+		}
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, path.Join(dir, x.Name()), nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		testingName := importName(f, "testing")
+		if testingName == "" {
+			continue
+		}
+		ast.Inspect(f, func(n ast.Node) bool {
+			spec, ok := n.(*ast.TypeSpec)
+			if !ok {
+				return true
+			}
+			st, ok := spec.Type.(*ast.StructType)
+			if !ok {
+				return true
+			}
+			for _, field := range st.Fields.List {
+				t := field.Type
+				if star, ok := t.(*ast.StarExpr); ok {
+					t = star.X
+				}
+				sel, ok := t.(*ast.SelectorExpr)
+				if !ok || sel.Sel.Name != "B" {
+					continue
+				}
+				ident, ok := sel.X.(*ast.Ident)
+				if !ok || ident.Name != testingName {
+					continue
+				}
+				names := field.Names
+				if len(names) == 0 {
+					names = []*ast.Ident{sel.Sel}
+				}
+				for _, name := range names {
+					wrappers[spec.Name.Name] = append(wrappers[spec.Name.Name], name.Name)
+				}
+			}
+			return true
+		})
+	}
+	return wrappers, nil
+}
+
+// findRemainingRef returns the position of the first reference to id in root,
+// or token.NoPos. If the reference is part of a composite literal of one of
+// the wrappers types, or is assigned to a field named like their testing.B
+// fields, the name of the type is returned too.
+// Selections (id.X) are not references if allowSelectors is true, and neither
+// are the arguments of helperCalls.
+func findRemainingRef(root ast.Node, id *ast.Ident, wrappers map[string][]string, helperCalls map[*ast.CallExpr]bool, allowSelectors bool) (token.Pos, string) {
+	pos := token.NoPos
+	wrapper := ""
+	var stack []ast.Node
+	ast.Inspect(root, func(n ast.Node) bool {
+		if pos.IsValid() {
+			return false
+		}
+		if n == nil {
+			stack = stack[:len(stack)-1]
+			return true
+		}
+		stack = append(stack, n)
+		ident, ok := n.(*ast.Ident)
+		if !ok || ident.Obj != id.Obj {
+			return true
+		}
+		if len(stack) > 1 {
+			if sel, ok := stack[len(stack)-2].(*ast.SelectorExpr); ok && allowSelectors && sel.X == ident {
+				return true
+			}
+			if call, ok := stack[len(stack)-2].(*ast.CallExpr); ok && helperCalls[call] {
+				return true
+			}
+		}
+		pos = ident.Pos()
+		wrapper = wrapperOf(stack, wrappers)
+		return true
+	})
+	return pos, wrapper
+}
+
+// wrapperOf returns the name of the type of wrappers the last node of stack,
+// a path from the root of a tree, is wrapped in, or "". The type is known
+// from a composite literal, including an element of a slice, array or map
+// literal whose type is elided, or guessed from the name of the field the
+// node is assigned to.
+func wrapperOf(stack []ast.Node, wrappers map[string][]string) string {
+	n := stack[len(stack)-1]
+	if as, ok := stack[len(stack)-2].(*ast.AssignStmt); ok && len(as.Lhs) == len(as.Rhs) {
+		for i, rhs := range as.Rhs {
+			sel, ok := as.Lhs[i].(*ast.SelectorExpr)
+			if rhs != n || !ok {
+				continue
+			}
+			var names []string
+			for name, fields := range wrappers {
+				for _, f := range fields {
+					if f == sel.Sel.Name {
+						names = append(names, name)
+					}
+				}
+			}
+			if len(names) > 0 {
+				sort.Strings(names)
+				return names[0]
+			}
+		}
+	}
+
+	for i := len(stack) - 1; i >= 0; i-- {
+		lit, ok := stack[i].(*ast.CompositeLit)
+		if !ok {
+			continue
+		}
+		t := lit.Type
+		// Elided type: the element type of the enclosing literal.
+		for j := i - 1; t == nil && j >= 0; j-- {
+			if _, ok := stack[j].(*ast.KeyValueExpr); ok {
+				continue
+			}
+			outer, ok := stack[j].(*ast.CompositeLit)
+			if !ok {
+				break
+			}
+			switch ot := outer.Type.(type) {
+			case *ast.ArrayType:
+				t = ot.Elt
+			case *ast.MapType:
+				t = ot.Value
+			}
+			break
+		}
+		if star, ok := t.(*ast.StarExpr); ok {
+			t = star.X
+		}
+		if id, ok := t.(*ast.Ident); ok && wrappers[id.Name] != nil {
+			return id.Name
+		}
+	}
+	return ""
+}
+
+// importName returns the name under which the package at importPath is
+// imported in f, or "" if it is not imported.
+func importName(f *ast.File, importPath string) string {
+	for _, spec := range f.Imports {
+		if strings.Trim(spec.Path.Value, `"`) != importPath {
+			continue
+		}
+		if spec.Name != nil {
+			return spec.Name.Name
+		}
+		return path.Base(importPath)
+	}
+	return ""
+}
+
+// isBenchLoop returns true if the for statement is of the form
+// for ?; ? < b.?; ? {}, where b is id. The init and post statements may be
+// missing.
+func isBenchLoop(v *ast.ForStmt, id *ast.Ident) bool {
+	op, ok := v.Cond.(*ast.BinaryExpr)
+	if !ok || op.Op != token.LSS {
+		return false
+	}
+	sel, ok := op.Y.(*ast.SelectorExpr)
+	if !ok {
+		return false
+	}
+	ident, ok := sel.X.(*ast.Ident)
+	return ok && ident.Obj == id.Obj
+}
+
+// isBenchRange returns true if the range statement is of the form
+// for ? := range b.N {}, where b is id, or of the form for range b.N {}.
+func isBenchRange(v *ast.RangeStmt, id *ast.Ident) bool {
+	sel, ok := v.X.(*ast.SelectorExpr)
+	if !ok || sel.Sel.Name != "N" {
+		return false
+	}
+	ident, ok := sel.X.(*ast.Ident)
+	return ok && ident.Obj == id.Obj
+}
+
+// tickStmt returns a call of opts.tickFunc with cont as argument, as a
+// statement.
+func tickStmt(pos token.Pos, opts rewriteOptions, cont bool) ast.Stmt {
+	return &ast.ExprStmt{X: &ast.CallExpr{
+		Fun:  opts.hookRef(pos, opts.tickFunc),
+		Args: []ast.Expr{&ast.Ident{NamePos: pos, Name: fmt.Sprint(cont)}},
+	}}
+}
+
+// findFuncDecl returns the declaration of the package-level function name in
+// f. Methods are ignored.
+func findFuncDecl(f *ast.File, name string) *ast.FuncDecl {
+	for _, decl := range f.Decls {
+		fd, ok := decl.(*ast.FuncDecl)
+		if ok && fd.Recv == nil && fd.Name.Name == name {
+			return fd
+		}
+	}
+	return nil
+}
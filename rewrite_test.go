@@ -0,0 +1,1349 @@
+package main
+
+import (
+	"bytes"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// rewriteTest is a benchmark file rewritten by rewriteBenchFuncInPlace, with
+// the benchmark function expected once rewritten, or a part of the error.
+type rewriteTest struct {
+	name string
+	// Source of p_test.go, holding the benchmark, and of the other files
+	// of the package, by name.
+	src   string
+	files map[string]string
+	// Name of the benchmark, BenchmarkX if empty.
+	bench string
+	opts  rewriteOptions
+	// The rewritten benchmark, or a part of the error of the rewrite.
+	want string
+	err  string
+	// If not empty, the generated file of the copies of the helpers declared
+	// in p_test.go.
+	helpers string
+	// If not empty, the start of the rewritten file.
+	header string
+}
+
+var rewriteTests = []rewriteTest{
+	{
+		name: "loop",
+		src: `package p
+
+import "testing"
+
+func BenchmarkX(b *testing.B) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		work(i)
+	}
+}
+`,
+		want: `func BenchmarkX() {
+
+	for i := 0; i < GoBBN; i++ {
+		work(i)
+	}
+}`,
+	},
+	{
+		name: "range over make",
+		src: `package p
+
+import "testing"
+
+func BenchmarkX(b *testing.B) {
+	for i := range make([]int, b.N) {
+		work(i)
+	}
+}
+`,
+		want: `func BenchmarkX() {
+	for i := range make([]int, GoBBN) {
+		work(i)
+	}
+}`,
+	},
+	{
+		name: "b passed to a function",
+		src: `package p
+
+import "testing"
+
+func BenchmarkX(b *testing.B) {
+	use(b)
+}
+
+func use(tb testing.TB) {}
+`,
+		err: "BenchmarkX uses b other than through b.N or a method call",
+	},
+	{
+		name: "testing.B type",
+		src: `package p
+
+import "testing"
+
+func BenchmarkX(b *testing.B) {
+	var other *testing.B
+	_ = other
+}
+`,
+		err: "BenchmarkX refers to the testing.B type",
+	},
+	{
+		name: "build constraints",
+		src: `//go:build linux || !linux
+// +build linux !linux
+
+// Package p is benchmarked.
+package p
+
+import "testing"
+
+func BenchmarkX(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		work(i)
+	}
+}
+`,
+		want: `func BenchmarkX() {
+	for i := 0; i < GoBBN; i++ {
+		work(i)
+	}
+}`,
+		header: `//go:build linux || !linux
+// +build linux !linux
+
+// Package p is benchmarked.
+package p
+`,
+	},
+	{
+		name: "integer conversions",
+		src: `package p
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func BenchmarkX(b *testing.B) {
+	r := rand.New(rand.NewSource(int64(b.N)))
+	seed := uint64(b.N)
+	for i := 0; i < b.N; i++ {
+		work(r.Intn(10) + int(seed))
+	}
+}
+`,
+		want: `func BenchmarkX() {
+	r := rand.New(rand.NewSource(int64(GoBBN)))
+	seed := uint64(GoBBN)
+	for i := 0; i < GoBBN; i++ {
+		work(r.Intn(10) + int(seed))
+	}
+}`,
+	},
+	{
+		name: "anonymous struct field",
+		src: `package p
+
+import "testing"
+
+func BenchmarkX(b *testing.B) {
+	cfg := struct{ N int }{N: b.N}
+	for i := 0; i < cfg.N; i++ {
+		work(i)
+	}
+}
+`,
+		want: `func BenchmarkX() {
+	cfg := struct{ N int }{N: GoBBN}
+	for i := 0; i < cfg.N; i++ {
+		work(i)
+	}
+}`,
+	},
+	{
+		name: "testing.B wrapper",
+		src: `package p
+
+import "testing"
+
+type bench struct {
+	*testing.B
+	input string
+}
+
+func (x bench) run() {
+	for i := 0; i < x.N; i++ {
+		work(i)
+	}
+}
+
+func BenchmarkX(b *testing.B) {
+	bench{b, "x"}.run()
+}
+`,
+		err: "BenchmarkX wraps b in bench, a type holding a testing.B; benchmarks using such wrappers are not supported",
+	},
+	{
+		name: "helper bound to a variable",
+		src: `package p
+
+import "testing"
+
+func BenchmarkX(b *testing.B) {
+	work := realWork
+	work(b)
+}
+
+func realWork(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		step()
+	}
+}
+`,
+		want: `func BenchmarkX() {
+	work := gobbRealWork
+	work()
+}`,
+		helpers: `// Code generated by go-bb. DO NOT EDIT.
+
+package p
+
+func gobbRealWork() {
+	for i := 0; i < GoBBN; i++ {
+		step()
+	}
+}
+`,
+	},
+	{
+		name: "helper bound to a variable used otherwise",
+		src: `package p
+
+import "testing"
+
+func BenchmarkX(b *testing.B) {
+	work := realWork
+	record(work)
+	work(b)
+}
+
+func realWork(b *testing.B) {}
+`,
+		err: "BenchmarkX uses b other than through b.N or a method call",
+	},
+	{
+		name: "b.N as size and bound",
+		src: `package p
+
+import "testing"
+
+func BenchmarkX(b *testing.B) {
+	data := make([]int, b.N)
+	for i := 0; i < b.N; i++ {
+		data[i] = i
+	}
+}
+`,
+		want: `func BenchmarkX() {
+	data := make([]int, GoBBN)
+	for i := 0; i < GoBBN; i++ {
+		data[i] = i
+	}
+}`,
+	},
+	{
+		name: "bound copied to a variable",
+		src: `package p
+
+import "testing"
+
+func BenchmarkX(b *testing.B) {
+	limit := b.N
+	for i := 0; i < limit; i++ {
+		work(i)
+	}
+}
+`,
+		want: `func BenchmarkX() {
+	limit := GoBBN
+	for i := 0; i < limit; i++ {
+		work(i)
+	}
+}`,
+	},
+	{
+		name: "goroutine count",
+		src:  goroutineCountSrc,
+		want: `func BenchmarkX() {
+	workers := GoBBN / batchSize
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			work(batchSize)
+		}()
+	}
+	wg.Wait()
+}`,
+	},
+	{
+		name: "floating-point conversions",
+		src: `package p
+
+import "testing"
+
+func BenchmarkX(b *testing.B) {
+	ops := float64(b.N)
+	half := float32(b.N) / 2
+	for i := 0; i < b.N; i++ {
+		work(i)
+	}
+	report(ops, half)
+}
+`,
+		want: `func BenchmarkX() {
+	ops := float64(GoBBN)
+	half := float32(GoBBN) / 2
+	for i := 0; i < GoBBN; i++ {
+		work(i)
+	}
+	report(ops, half)
+}`,
+	},
+	{
+		name: "labeled loop",
+		src: `package p
+
+import "testing"
+
+func BenchmarkX(b *testing.B) {
+	x := []int{1, 2, 3}
+outer:
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < len(x); j++ {
+			if x[j] == i {
+				break outer
+			}
+		}
+	}
+}
+`,
+		want: `func BenchmarkX() {
+	x := []int{1, 2, 3}
+outer:
+	for i := 0; i < GoBBN; i++ {
+		for j := 0; j < len(x); j++ {
+			if x[j] == i {
+				break outer
+			}
+		}
+	}
+}`,
+	},
+	{
+		name: "multi-value assignment of b",
+		src: `package p
+
+import "testing"
+
+func BenchmarkX(b *testing.B) {
+	b, cleanup := setup(b)
+	defer cleanup()
+	for i := 0; i < b.N; i++ {
+		work(i)
+	}
+}
+`,
+		err: "assigns or passes b in a multi-value assignment",
+	},
+	{
+		name: "loops in both arms of an if",
+		src: `package p
+
+import "testing"
+
+func BenchmarkX(b *testing.B) {
+	if fast {
+		for i := 0; i < b.N; i++ {
+			quick(i)
+		}
+	} else {
+		for i := 0; i < b.N; i++ {
+			slow(i)
+		}
+	}
+}
+`,
+		want: `func BenchmarkX() {
+	if fast {
+		for i := 0; i < GoBBN; i++ {
+			quick(i)
+		}
+	} else {
+		for i := 0; i < GoBBN; i++ {
+			slow(i)
+		}
+	}
+}`,
+	},
+	{
+		name: "type switch on b",
+		src: `package p
+
+import "testing"
+
+func BenchmarkX(b *testing.B) {
+	switch any(b).(type) {
+	case testing.TB:
+	}
+	for i := 0; i < b.N; i++ {
+		work(i)
+	}
+}
+`,
+		err: "asserts the dynamic type of b",
+	},
+	{
+		name: "local copy of b",
+		src: `package p
+
+import "testing"
+
+func BenchmarkX(b *testing.B) {
+	bp := b
+	bp.ReportAllocs()
+	for i := 0; i < bp.N; i++ {
+		work(i)
+	}
+}
+`,
+		want: `func BenchmarkX() {
+
+	for i := 0; i < GoBBN; i++ {
+		work(i)
+	}
+}`,
+	},
+	{
+		name: "loop index used for addressing",
+		src: `package p
+
+import "testing"
+
+func BenchmarkX(b *testing.B) {
+	data := []int{1, 2, 3}
+	sum := 0
+	for i := 0; i < b.N; i++ {
+		sum += data[i%len(data)]
+	}
+	_ = sum
+}
+`,
+		want: `func BenchmarkX() {
+	data := []int{1, 2, 3}
+	sum := 0
+	for i := 0; i < GoBBN; i++ {
+		sum += data[i%len(data)]
+	}
+	_ = sum
+}`,
+	},
+	{
+		name: "b.N in a deferred call",
+		src: `package p
+
+import "testing"
+
+func BenchmarkX(b *testing.B) {
+	defer summarize(b.N)
+	for i := 0; i < b.N; i++ {
+		work(i)
+	}
+}
+`,
+		want: `func BenchmarkX() {
+	defer summarize(GoBBN)
+	for i := 0; i < GoBBN; i++ {
+		work(i)
+	}
+}`,
+	},
+	{
+		name: "testing.B wrapper with a keyed field",
+		src: `package p
+
+import "testing"
+
+type suite struct {
+	*testing.B
+}
+
+func BenchmarkX(b *testing.B) {
+	s := &suite{B: b}
+	for i := 0; i < s.N; i++ {
+		work(i)
+	}
+}
+`,
+		err: "BenchmarkX wraps b in suite",
+	},
+	{
+		name: "testing.B wrapper with an assigned field",
+		src: `package p
+
+import "testing"
+
+type suite struct {
+	*testing.B
+}
+
+func BenchmarkX(b *testing.B) {
+	var s suite
+	s.B = b
+	for i := 0; i < s.N; i++ {
+		work(i)
+	}
+}
+`,
+		err: "p_test.go:11: BenchmarkX wraps b in suite",
+	},
+	{
+		name: "first run check",
+		src: `package p
+
+import "testing"
+
+func BenchmarkX(b *testing.B) {
+	if b.N == 1 {
+		warmup()
+	}
+	for i := 0; i < b.N; i++ {
+		work(i)
+	}
+}
+`,
+		want: `func BenchmarkX() {
+	{
+		warmup()
+	}
+	for i := 0; i < GoBBN; i++ {
+		work(i)
+	}
+}`,
+	},
+	{
+		name: "strings.Repeat of b.N",
+		src:  repeatSrc,
+		want: `func BenchmarkX() {
+	s := strings.Repeat("x", GoBBN)
+	for i := 0; i < GoBBN; i++ {
+		work(s[i])
+	}
+}`,
+	},
+	{
+		name: "map pre-grown to b.N entries",
+		src:  mapSizeSrc,
+		want: `func BenchmarkX() {
+	m := make(map[int]int, GoBBN)
+	for i := 0; i < GoBBN; i++ {
+		m[i] = i
+	}
+}`,
+	},
+	{
+		name: "b.Loop",
+		src: `package p
+
+import "testing"
+
+func BenchmarkX(b *testing.B) {
+	for b.Loop() {
+		work(0)
+	}
+}
+`,
+		want: `func BenchmarkX() {
+	for i := 0; i < GoBBN; i++ {
+		work(0)
+	}
+}`,
+	},
+	{
+		name: "helper",
+		src: `package p
+
+import "testing"
+
+func BenchmarkX(b *testing.B) {
+	run(b, 2)
+}
+
+func run(b *testing.B, n int) {
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		work(n)
+	}
+}
+`,
+		want: `func BenchmarkX() {
+	gobbRun(2)
+}`,
+		helpers: `// Code generated by go-bb. DO NOT EDIT.
+
+package p
+
+func gobbRun(n int) {
+
+	for i := 0; i < GoBBN; i++ {
+		work(n)
+	}
+}
+`,
+	},
+	{
+		name: "helper in a constrained file",
+		src: `//go:build linux || !linux
+// +build linux !linux
+
+package p
+
+import "testing"
+
+func BenchmarkX(b *testing.B) {
+	run(b)
+}
+
+func run(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		work(i)
+	}
+}
+`,
+		want: `func BenchmarkX() {
+	gobbRun()
+}`,
+		helpers: `// Code generated by go-bb. DO NOT EDIT.
+
+//go:build linux || !linux
+// +build linux !linux
+
+package p
+
+func gobbRun() {
+	for i := 0; i < GoBBN; i++ {
+		work(i)
+	}
+}
+`,
+	},
+	{
+		name: "unused testing import",
+		src: `package p
+
+import (
+	"strconv"
+	"testing"
+)
+
+func BenchmarkX(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		strconv.Itoa(i)
+	}
+}
+`,
+		want: `func BenchmarkX() {
+	for i := 0; i < GoBBN; i++ {
+		strconv.Itoa(i)
+	}
+}`,
+		header: `package p
+
+import (
+	"strconv"
+)
+
+//go:noinline
+func BenchmarkX() {`,
+	},
+	{
+		name: "testing import used by another declaration",
+		src: `package p
+
+import "testing"
+
+func BenchmarkX(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		work(i)
+	}
+}
+
+func TestX(t *testing.T) {}
+`,
+		want: `func BenchmarkX() {
+	for i := 0; i < GoBBN; i++ {
+		work(i)
+	}
+}`,
+		header: `package p
+
+import "testing"
+`,
+	},
+	{
+		name: "stub source, default rewrite",
+		src:  stubSrc,
+		want: `func BenchmarkX() {
+
+	for i := 0; i < GoBBN; i++ {
+		if work(i) < 0 {
+			GoBBFatal("negative")
+		}
+	}
+}`,
+	},
+	{
+		name: "inline stubs",
+		src:  stubSrc,
+		opts: rewriteOptions{stubType: stubType},
+		want: `func BenchmarkX() {
+	b := GoBBNewB("BenchmarkX")
+	defer b.GoBBDone()
+	b.ReportAllocs()
+	b.SetBytes(8)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if work(i) < 0 {
+			b.Fatal("negative")
+		}
+	}
+}`,
+	},
+	{
+		name: "inline stubs, bookkeeping stripped",
+		src:  stubSrc,
+		opts: rewriteOptions{stubType: stubType, stripBookkeeping: true},
+		want: `func BenchmarkX() {
+	b := GoBBNewB("BenchmarkX")
+	defer b.GoBBDone()
+
+	for i := 0; i < b.N; i++ {
+		if work(i) < 0 {
+			b.Fatal("negative")
+		}
+	}
+}`,
+	},
+	{
+		name: "runtime hints preserved",
+		src:  runtimeHintsSrc,
+		want: `func BenchmarkX() {
+	runtime.GC()
+	for i := 0; i < GoBBN; i++ {
+		work(i)
+		runtime.Gosched()
+	}
+}`,
+	},
+	{
+		name: "runtime hints stripped",
+		src:  runtimeHintsSrc,
+		opts: rewriteOptions{stripRuntimeHints: true},
+		want: `func BenchmarkX() {
+
+	for i := 0; i < GoBBN; i++ {
+		work(i)
+
+	}
+}`,
+		header: `package p
+
+//go:noinline
+`,
+	},
+	{
+		name: "runtime hints stripped, runtime still used",
+		src: `package p
+
+import (
+	"runtime"
+	"testing"
+)
+
+func BenchmarkX(b *testing.B) {
+	procs := runtime.NumCPU()
+	for i := 0; i < b.N; i++ {
+		work(procs)
+		runtime.Gosched()
+	}
+}
+`,
+		opts: rewriteOptions{stripRuntimeHints: true},
+		want: `func BenchmarkX() {
+	procs := runtime.NumCPU()
+	for i := 0; i < GoBBN; i++ {
+		work(procs)
+
+	}
+}`,
+		header: `package p
+
+import (
+	"runtime"
+)
+
+//go:noinline
+`,
+	},
+	{
+		name: "body is a single b.Run",
+		src: `package p
+
+import "testing"
+
+func BenchmarkX(b *testing.B) {
+	b.Run("sub", func(b *testing.B) {
+		data := make([]int, 10)
+		for i := 0; i < b.N; i++ {
+			work(data[i%len(data)])
+		}
+	})
+}
+`,
+		want: `func BenchmarkX() {
+	{
+		data := make([]int, 10)
+		for i := 0; i < GoBBN; i++ {
+			work(data[i%len(data)])
+		}
+	}
+}`,
+	},
+	{
+		name: "b.Logf in the loop",
+		src:  logfSrc,
+		want: `func BenchmarkX() {
+	for i := 0; i < GoBBN; i++ {
+
+	}
+	for i := 0; i < GoBBN; i++ {
+		if v := work(i); v < 0 {
+
+		}
+	}
+}`,
+	},
+	{
+		name: "b.Logf in the loop, logs kept",
+		src:  logfSrc,
+		opts: rewriteOptions{keepLogs: true},
+		want: `func BenchmarkX() {
+	for i := 0; i < GoBBN; i++ {
+		GoBBLogf("iteration %d", i)
+	}
+	for i := 0; i < GoBBN; i++ {
+		if v := work(i); v < 0 {
+			GoBBLogf("negative: %d", v)
+		}
+	}
+}`,
+	},
+	{
+		name: "loop with no init nor post",
+		src: `package p
+
+import "testing"
+
+func BenchmarkX(b *testing.B) {
+	total := 0
+	for ; total < b.N; {
+		total += work(total)
+	}
+}
+`,
+		want: `func BenchmarkX() {
+	total := 0
+	for total < GoBBN {
+		total += work(total)
+	}
+}`,
+	},
+	{
+		name: "b.N stored in a field",
+		src: `package p
+
+import "testing"
+
+type state struct {
+	n int
+}
+
+func BenchmarkX(b *testing.B) {
+	s := &state{}
+	s.n = b.N
+	for i := 0; i < s.n; i++ {
+		work(i)
+	}
+}
+`,
+		want: `func BenchmarkX() {
+	s := &state{}
+	s.n = GoBBN
+	for i := 0; i < s.n; i++ {
+		work(i)
+	}
+}`,
+	},
+	{
+		name: "loop bounded by a multiple of b.N",
+		src: `package p
+
+import "testing"
+
+const factor = 4
+
+func BenchmarkX(b *testing.B) {
+	for i := 0; i < b.N*factor; i++ {
+		work(i)
+	}
+}
+`,
+		want: `func BenchmarkX() {
+	for i := 0; i < GoBBN*factor; i++ {
+		work(i)
+	}
+}`,
+	},
+	{
+		name: "channel receive in the loop",
+		src: `package p
+
+import "testing"
+
+func BenchmarkX(b *testing.B) {
+	ch := make(chan int, b.N)
+	for i := 0; i < b.N; i++ {
+		ch <- i
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		work(<-ch)
+	}
+}
+`,
+		want: `func BenchmarkX() {
+	ch := make(chan int, GoBBN)
+	for i := 0; i < GoBBN; i++ {
+		ch <- i
+	}
+
+	for i := 0; i < GoBBN; i++ {
+		work(<-ch)
+	}
+}`,
+	},
+	{
+		name: "local func shadowing a helper",
+		src:  shadowedHelperSrc,
+		want: `func BenchmarkX() {
+	gobbHelper(1)
+	{
+		helper := func(n int) { work(n) }
+		for i := 0; i < GoBBN; i++ {
+			helper(i)
+		}
+	}
+}`,
+		helpers: `// Code generated by go-bb. DO NOT EDIT.
+
+package p
+
+func gobbHelper(n int) {
+	for i := 0; i < GoBBN; i++ {
+		work(n)
+	}
+}
+`,
+	},
+	{
+		name: "local func shadowing a helper, inline stubs",
+		src:  shadowedHelperSrc,
+		opts: rewriteOptions{stubType: stubType},
+		want: `func BenchmarkX() {
+	b := GoBBNewB("BenchmarkX")
+	defer b.GoBBDone()
+	gobbHelper(b, 1)
+	{
+		helper := func(n int) { work(n) }
+		for i := 0; i < b.N; i++ {
+			helper(i)
+		}
+	}
+}`,
+		helpers: `// Code generated by go-bb. DO NOT EDIT.
+
+package p
+
+func gobbHelper(b *GoBBB, n int) {
+	for i := 0; i < b.N; i++ {
+		work(n)
+	}
+}
+`,
+	},
+}
+
+// stubSrc is rewritten both by default and with -inline-stubs, to compare them.
+const stubSrc = `package p
+
+import "testing"
+
+func BenchmarkX(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(8)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if work(i) < 0 {
+			b.Fatal("negative")
+		}
+	}
+}
+`
+
+const runtimeHintsSrc = `package p
+
+import (
+	"runtime"
+	"testing"
+)
+
+func BenchmarkX(b *testing.B) {
+	runtime.GC()
+	for i := 0; i < b.N; i++ {
+		work(i)
+		runtime.Gosched()
+	}
+}
+`
+
+const logfSrc = `package p
+
+import "testing"
+
+func BenchmarkX(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		b.Logf("iteration %d", i)
+	}
+	for i := 0; i < b.N; i++ {
+		if v := work(i); v < 0 {
+			b.Logf("negative: %d", v)
+		}
+	}
+}
+`
+
+// shadowedHelperSrc declares a package helper taking b, which the benchmark
+// calls, and a local func of the same name in a nested scope, which it calls
+// too.
+const shadowedHelperSrc = `package p
+
+import "testing"
+
+func helper(b *testing.B, n int) {
+	for i := 0; i < b.N; i++ {
+		work(n)
+	}
+}
+
+func BenchmarkX(b *testing.B) {
+	helper(b, 1)
+	{
+		helper := func(n int) { work(n) }
+		for i := 0; i < b.N; i++ {
+			helper(i)
+		}
+	}
+}
+`
+
+func TestRewrite(t *testing.T) {
+	for _, tc := range rewriteTests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			files := map[string]string{"p_test.go": tc.src}
+			for name, src := range tc.files {
+				files[name] = src
+			}
+			for name, src := range files {
+				err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			bench := tc.bench
+			if bench == "" {
+				bench = "BenchmarkX"
+			}
+			opts := tc.opts
+			if opts.iterationsVar == "" {
+				opts.iterationsVar = iterationsVar
+			}
+
+			err := rewriteBenchFuncInPlace(dir, fnLoc{file: "p_test.go", name: bench}, opts)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("got error %v, want one containing %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := rewrittenFunc(t, filepath.Join(dir, "p_test.go"), bench); got != tc.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tc.want)
+			}
+			if tc.header != "" {
+				b, err := os.ReadFile(filepath.Join(dir, "p_test.go"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !strings.HasPrefix(string(b), tc.header) {
+					t.Errorf("got file:\n%s\nwant it to start with:\n%s", b, tc.header)
+				}
+			}
+			if tc.helpers != "" {
+				b, err := os.ReadFile(filepath.Join(dir, helpersFileName(bench, "p_test.go")))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := string(b); got != tc.helpers {
+					t.Errorf("got helpers:\n%s\nwant:\n%s", got, tc.helpers)
+				}
+			}
+		})
+	}
+}
+
+// rewrittenFunc returns the source of the function name of the file at
+// filePath, without its doc comment.
+func rewrittenFunc(t *testing.T, filePath, name string) string {
+	t.Helper()
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, filePath, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := findFuncDecl(f, name)
+	if d == nil {
+		t.Fatalf("%s not found in %s", name, filePath)
+	}
+	var buf bytes.Buffer
+	err = format.Node(&buf, fset, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestRemovePackageRefs(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		// The file once the references are removed, or a part of the
+		// error.
+		want string
+		err  string
+	}{
+		{
+			name: "blank",
+			src: `package p
+
+import "testing"
+
+var _ = BenchmarkX
+
+var (
+	_    = []func(*testing.B){BenchmarkX}
+	keep = 1
+)
+
+func BenchmarkX() {}
+`,
+			want: `package p
+
+var (
+	keep = 1
+)
+
+func BenchmarkX() {}
+`,
+		},
+		{
+			name: "named",
+			src: `package p
+
+var registered = BenchmarkX
+
+func BenchmarkX() {}
+`,
+			err: "package-level variable registered refers to BenchmarkX, whose signature is changed by the rewrite",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			filePath := filepath.Join(dir, "p.go")
+			err := os.WriteFile(filePath, []byte(tc.src), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = removePackageRefs(dir, map[string]bool{"BenchmarkX": true})
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("got error %v, want one containing %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := os.ReadFile(filePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(b); got != tc.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tc.want)
+			}
+		})
+	}
+}
+
+const goroutineCountSrc = `package p
+
+import (
+	"sync"
+	"testing"
+)
+
+func BenchmarkX(b *testing.B) {
+	workers := b.N / batchSize
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			work(batchSize)
+		}()
+	}
+	wg.Wait()
+}
+`
+
+// parseBench parses src, the source of a file, and returns its benchmark
+// BenchmarkX and the identifier of its parameter.
+func parseBench(t *testing.T, src string) (*token.FileSet, *ast.File, *ast.FuncDecl, *ast.Ident) {
+	t.Helper()
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "p_test.go", src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := findFuncDecl(f, "BenchmarkX")
+	if d == nil {
+		t.Fatal("BenchmarkX not found")
+	}
+	return fset, f, d, d.Type.Params.List[0].Names[0]
+}
+
+func TestFindGoroutineLoops(t *testing.T) {
+	fset, _, d, id := parseBench(t, goroutineCountSrc)
+	var lines []int
+	for _, pos := range findGoroutineLoops(d.Body, id) {
+		lines = append(lines, fset.Position(pos).Line)
+	}
+	if want := []int{11}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("got loops at lines %v, want %v", lines, want)
+	}
+}
+
+const repeatSrc = `package p
+
+import (
+	"strings"
+	"testing"
+)
+
+func BenchmarkX(b *testing.B) {
+	s := strings.Repeat("x", b.N)
+	for i := 0; i < b.N; i++ {
+		work(s[i])
+	}
+}
+`
+
+const mapSizeSrc = `package p
+
+import "testing"
+
+func BenchmarkX(b *testing.B) {
+	m := make(map[int]int, b.N)
+	for i := 0; i < b.N; i++ {
+		m[i] = i
+	}
+}
+`
+
+func TestFindProportionalAllocs(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []string
+	}{
+		{"strings.Repeat", repeatSrc, []string{"strings.Repeat"}},
+		{"map", mapSizeSrc, []string{"make"}},
+		{"counted loop", goroutineCountSrc, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, f, d, id := parseBench(t, test.src)
+			var got []string
+			for _, site := range findProportionalAllocs(f, d.Body, id) {
+				got = append(got, site.fun)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got allocations %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestHelpersFileName(t *testing.T) {
+	tests := []struct {
+		source, want string
+	}{
+		{"p_test.go", "zz_gobb_helpers_BenchmarkX_p_gen.go"},
+		{"p.go", "zz_gobb_helpers_BenchmarkX_p_gen.go"},
+		{"p_linux_amd64_test.go", "zz_gobb_helpers_BenchmarkX_p_gen_linux_amd64.go"},
+		{"linux_amd64.go", "zz_gobb_helpers_BenchmarkX_linux_gen_amd64.go"},
+	}
+	for _, test := range tests {
+		if got := helpersFileName("BenchmarkX", test.source); got != test.want {
+			t.Errorf("helpersFileName(%q) = %q, want %q", test.source, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// sandboxKeptEnv are the environment variables -sandbox keeps: what the go
+// command and the toolchain need to run at all.
+var sandboxKeptEnv = []string{
+	"PATH",
+	"TMPDIR",
+	// Windows.
+	"SYSTEMROOT",
+	"TEMP",
+	"TMP",
+}
+
+// enterSandbox replaces the environment of go-bb, and thus of the commands it
+// runs, with a minimal one rooted at a new temporary directory, which it
+// returns:
+//
+//   - only sandboxKeptEnv is inherited, and GOENV=off ignores go env -w;
+//   - HOME, GOPATH, the module cache and the build cache are in the
+//     directory, so nothing of the user's is read nor written, except the
+//     downloaded modules, which are read from the module cache; the
+//     module cache of the sandbox is writable, with -modcacherw, so that the
+//     directory can be removed;
+//   - the network is not used: the module cache serves as proxy, as with
+//     -offline, and GOSUMDB is off;
+//   - cgo is disabled, so no C compiler runs with flags from the code.
+func enterSandbox() (string, error) {
+	goroot := goEnv("GOROOT")
+	proxy := "file://" + filepath.ToSlash(path.Join(goEnv("GOMODCACHE"), "cache", "download"))
+
+	dir, err := makeTempDir()
+	if err != nil {
+		return "", err
+	}
+
+	kept := map[string]string{}
+	for _, name := range sandboxKeptEnv {
+		if v, ok := os.LookupEnv(name); ok {
+			kept[name] = v
+		}
+	}
+	os.Clearenv()
+	for name, v := range kept {
+		os.Setenv(name, v)
+	}
+
+	env := map[string]string{
+		"HOME":            dir,
+		"USERPROFILE":     dir,
+		"XDG_CACHE_HOME":  path.Join(dir, "cache"),
+		"XDG_CONFIG_HOME": path.Join(dir, "config"),
+		"GOENV":           "off",
+		"GOROOT":          goroot,
+		"GOPATH":          path.Join(dir, "go"),
+		"GOMODCACHE":      path.Join(dir, "go", "pkg", "mod"),
+		"GOCACHE":         path.Join(dir, "cache", "go-build"),
+		"GOFLAGS":         "-modcacherw",
+		"GOPROXY":         proxy,
+		"GOSUMDB":         "off",
+		"GOTOOLCHAIN":     "local",
+		"CGO_ENABLED":     "0",
+	}
+	for name, v := range env {
+		os.Setenv(name, v)
+	}
+	return dir, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path"
+	"strings"
+)
+
+// setFlag is a flag or package-level variable set with -set-flag before the
+// benchmark runs.
+type setFlag struct {
+	Name  string
+	Value string
+	// True if the copied package declares a package-level variable named
+	// Name, used when no flag is registered under that name.
+	Var bool
+}
+
+// splitSetFlag parses the argument of -set-flag.
+func splitSetFlag(x string) (setFlag, error) {
+	eq := strings.Index(x, "=")
+	if eq <= 0 {
+		return setFlag{}, fmt.Errorf("expected name=value")
+	}
+	return setFlag{Name: x[:eq], Value: x[eq+1:]}, nil
+}
+
+// packageVars returns the names of the package-level variables declared in
+// the Go files of dir, except the generated hooks.
+func packageVars(dir string) (map[string]bool, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	vars := map[string]bool{}
+	for _, x := range files {
+		if x.IsDir() || !strings.HasSuffix(x.Name(), ".go") || x.Name() == hooksFileName {
+			continue
+		}
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, path.Join(dir, x.Name()), nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, decl := range f.Decls {
+			gd, ok := decl.(*ast.GenDecl)
+			if !ok || gd.Tok != token.VAR {
+				continue
+			}
+			for _, spec := range gd.Specs {
+				for _, id := range spec.(*ast.ValueSpec).Names {
+					if id.Name != "_" {
+						vars[id.Name] = true
+					}
+				}
+			}
+		}
+	}
+	return vars, nil
+}
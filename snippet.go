@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"go/token"
+	"os"
+	"strings"
+)
+
+// snippetContext is the number of lines printed before and after the line of
+// a diagnostic.
+const snippetContext = 2
+
+// sourceSnippet returns the lines of source around pos, with a caret under
+// its column, like compilers print after an error. It returns an empty string
+// if the file cannot be read.
+func sourceSnippet(fset *token.FileSet, pos token.Pos) string {
+	p := fset.Position(pos)
+	if !p.IsValid() {
+		return ""
+	}
+	src, err := os.ReadFile(p.Filename)
+	if err != nil {
+		return ""
+	}
+	lines := strings.Split(string(src), "\n")
+	if p.Line > len(lines) {
+		return ""
+	}
+
+	first := p.Line - snippetContext
+	if first < 1 {
+		first = 1
+	}
+	last := p.Line + snippetContext
+	if last > len(lines) {
+		last = len(lines)
+	}
+	width := len(fmt.Sprint(last))
+
+	var b strings.Builder
+	for n := first; n <= last; n++ {
+		line := lines[n-1]
+		marker := " "
+		if n == p.Line {
+			marker = ">"
+		}
+		fmt.Fprintf(&b, "  %s %*d | %s\n", marker, width, n, line)
+		if n == p.Line && p.Column > 0 && p.Column <= len(line)+1 {
+			// Keep the tabs so that the caret lines up.
+			indent := strings.Map(func(r rune) rune {
+				if r == '\t' {
+					return r
+				}
+				return ' '
+			}, line[:p.Column-1])
+			fmt.Fprintf(&b, "    %*s | %s^\n", width, "", indent)
+		}
+	}
+	return b.String()
+}
+
+// withSnippet appends the source snippet of pos to the diagnostic msg.
+func withSnippet(msg string, fset *token.FileSet, pos token.Pos) string {
+	if snippet := sourceSnippet(fset, pos); snippet != "" {
+		return msg + "\n" + strings.TrimSuffix(snippet, "\n")
+	}
+	return msg
+}
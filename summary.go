@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// summary describes the binary produced by a successful run. It is printed
+// at the end in the format selected by -output-format.
+type summary struct {
+	Binary    string        `json:"binary"`
+	Functions []string      `json:"functions"`
+	Size      int64         `json:"size"`
+	BuildTime time.Duration `json:"-"`
+	// Path of the JavaScript glue running a js/wasm binary, if any.
+	WasmExec string `json:"wasm_exec,omitempty"`
+	// Path of the perf map written with -perf-map, if any.
+	PerfMap string `json:"perf_map,omitempty"`
+	// Path of the profile written with -merged-profile, if any.
+	MergedProfile string `json:"merged_profile,omitempty"`
+	// Path of the folded stacks written with -folded, if any.
+	Folded string `json:"folded,omitempty"`
+	// Toolchain experiments the binary was built with, if any.
+	GoExperiment string `json:"goexperiment,omitempty"`
+	// Value of -buildmode, if not the default.
+	BuildMode string `json:"buildmode,omitempty"`
+	// Inlining and escape analysis decisions about the benchmarks, with
+	// -optreport.
+	OptReport []string `json:"optreport,omitempty"`
+	// Path of the archive written with -bundle, if any.
+	Bundle string `json:"bundle,omitempty"`
+	// Outcome of the -after-build command, if any.
+	AfterBuild *hookResult `json:"after_build,omitempty"`
+	// Module versions and build settings embedded in the binary, in the
+	// format of go version -m, with -show-buildinfo.
+	BuildInfo string `json:"build_info,omitempty"`
+	// Calls of b removed or replaced, and statements rewritten, by the
+	// rewrite of the benchmarks.
+	Rewrites []rewriteChange `json:"rewrites,omitempty"`
+}
+
+func (s summary) writeText(w io.Writer) error {
+	_, err := fmt.Fprintln(w, "Benchmark binary ready at", s.Binary)
+	if err == nil && len(s.Rewrites) > 0 {
+		_, err = fmt.Fprintln(w, "Changes of the rewrite:")
+		for _, c := range s.Rewrites {
+			if err == nil {
+				_, err = fmt.Fprintf(w, "  %s:%d: %s\n", c.File, c.Line, c.Change)
+			}
+		}
+	}
+	if err == nil && s.BuildInfo != "" {
+		_, err = fmt.Fprintf(w, "Build information:\n%s", indent(s.BuildInfo, "  "))
+	}
+	if err == nil && len(s.OptReport) > 0 {
+		_, err = fmt.Fprintf(w, "Optimization report:\n%s", indent(strings.Join(s.OptReport, "\n")+"\n", "  "))
+	}
+	if err == nil && s.BuildMode != "" {
+		_, err = fmt.Fprintln(w, "Built with -buildmode", s.BuildMode)
+	}
+	if err == nil && s.GoExperiment != "" {
+		_, err = fmt.Fprintln(w, "Built with GOEXPERIMENT", s.GoExperiment)
+	}
+	if err == nil && s.PerfMap != "" {
+		_, err = fmt.Fprintln(w, "Perf map at", s.PerfMap)
+	}
+	if err == nil && s.MergedProfile != "" {
+		_, err = fmt.Fprintln(w, "Merged CPU profile at", s.MergedProfile)
+	}
+	if err == nil && s.Folded != "" {
+		_, err = fmt.Fprintln(w, "Folded stacks at", s.Folded)
+	}
+	if err == nil && s.Bundle != "" {
+		_, err = fmt.Fprintln(w, "Bundle of the prepared module at", s.Bundle)
+	}
+	if err == nil && s.AfterBuild != nil {
+		_, err = fmt.Fprintln(w, "After-build command", strings.Join(s.AfterBuild.Command, " "), "succeeded")
+	}
+	if err == nil && s.WasmExec != "" {
+		_, err = fmt.Fprintln(w, "JavaScript glue at", s.WasmExec)
+	}
+	return err
+}
+
+// indent prefixes each line of s with prefix.
+func indent(s, prefix string) string {
+	lines := strings.SplitAfter(s, "\n")
+	for i, l := range lines {
+		if l != "" {
+			lines[i] = prefix + l
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+func (s summary) writeJSON(w io.Writer) error {
+	type jsonSummary struct {
+		summary
+		BuildTimeSeconds float64 `json:"build_time_seconds"`
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(jsonSummary{
+		summary:          s,
+		BuildTimeSeconds: s.BuildTime.Seconds(),
+	})
+}
+
+func (s summary) write(w io.Writer, format string) error {
+	if format == "json" {
+		return s.writeJSON(w)
+	}
+	return s.writeText(w)
+}
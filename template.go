@@ -0,0 +1,975 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"os"
+	"strconv"
+	"text/template"
+
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+func renderMainToFile(data templateContext, filePath string) error {
+	return renderTemplateToFile(mainTemplate, data, filePath)
+}
+
+// renderHooksToFile generates a file in the copied package exposing the
+// functions the generated main uses to reach into it.
+func renderHooksToFile(data hooksContext, filePath string) error {
+	return renderTemplateToFile(hooksTemplate, data, filePath)
+}
+
+// renderTemplateToFile executes the Go source template tmpl, removes the
+// imports the result does not use, formats it and writes it to filePath.
+func renderTemplateToFile(tmpl string, data interface{}, filePath string) error {
+	var buf bytes.Buffer
+	t := template.Must(template.New("").Parse(tmpl))
+	err := t.Execute(&buf, data)
+	if err != nil {
+		return err
+	}
+
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, filePath, buf.Bytes(), parser.ParseComments)
+	if err != nil {
+		return fmt.Errorf("parsing generated code: %w", err)
+	}
+	removeUnusedImports(fset, f)
+
+	buf.Reset()
+	err = format.Node(&buf, fset, f)
+	if err != nil {
+		return fmt.Errorf("formatting generated code: %w", err)
+	}
+
+	return os.WriteFile(filePath, buf.Bytes(), 0644)
+}
+
+// removeUnusedImports deletes the imports of f that are not referenced.
+func removeUnusedImports(fset *token.FileSet, f *ast.File) {
+	imports := append([]*ast.ImportSpec(nil), f.Imports...)
+	for _, spec := range imports {
+		p, err := strconv.Unquote(spec.Path.Value)
+		if err != nil || (spec.Name != nil && spec.Name.Name == "_") {
+			continue
+		}
+		if !astutil.UsesImport(f, p) {
+			name := ""
+			if spec.Name != nil {
+				name = spec.Name.Name
+			}
+			astutil.DeleteNamedImport(fset, f, name, p)
+		}
+	}
+}
+
+// benchmarkEnv is the environment variable a -multi binary reads the name of
+// the benchmark to run from, when it is not given as first argument.
+const benchmarkEnv = "GOBB_BENCHMARK"
+
+// iterationsEnv is the environment variable overriding the value of b.N in
+// the benchmark binary.
+const iterationsEnv = "GOBB_ITERATIONS"
+
+// cpuProfileEnv is the environment variable a binary built with
+// -merged-profile reads the path of the CPU profile to write from.
+const cpuProfileEnv = "GOBB_CPUPROFILE"
+
+// runIDEnv is the environment variable naming the subdirectory of
+// -profile-dir a binary built with -profile-per-run writes its profiles to.
+const runIDEnv = "GOBB_RUN_ID"
+
+// iterationsVar is the variable of the copied package substituted for b.N.
+const iterationsVar = "GoBBN"
+
+type templateContext struct {
+	OrigImport string
+	// Import path of the external test package.
+	XTestImport   string
+	Funcs         []templateFunc
+	Multi         bool
+	BenchmarkEnv  string
+	IterationsEnv string
+	IterationsVar string
+	// Index of the argument holding the number of iterations.
+	IterationsArg int
+	// Default number of iterations, for the usage message.
+	Iterations int
+	// Absolute path of the file the benchmark reads from, or "-" for
+	// stdin. Empty if not set.
+	Input string
+	// True if the input is assigned to a package variable through
+	// GoBBSetInput rather than replacing os.Stdin.
+	InputVar bool
+	// True if the latency of the iterations is reported.
+	Latency bool
+	// True if GoBBSetFlags is called before running the benchmark.
+	SetFlags bool
+	// True if the binary writes a CPU profile to the file named by
+	// CPUProfileEnv, when set.
+	CPUProfile    bool
+	CPUProfileEnv string
+	// Absolute path of the directory the binary writes its CPU and heap
+	// profiles to, if any. With ProfilePerRun, they go in a subdirectory
+	// named by RunIDEnv, or else by the time the run starts.
+	ProfileDir    string
+	ProfilePerRun bool
+	RunIDEnv      string
+	// True if allocation and GC statistics of the run are printed.
+	Report bool
+}
+
+// templateFunc is a benchmark function called by the generated main.
+type templateFunc struct {
+	// Name the package of the function is imported as: orig or xtest.
+	Pkg  string
+	Name string
+	// Name the benchmark is selected with.
+	Key string
+}
+
+// The imports of the template are a superset of what the rendered code needs.
+// Unused ones are removed after rendering.
+const mainTemplate = `
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"runtime/metrics"
+	"runtime/pprof"
+	"strconv"
+	"syscall"
+	"time"
+
+	orig "{{.OrigImport}}"
+	xtest "{{.XTestImport}}"
+)
+
+func main() {
+{{- if .Multi}}
+	name := os.Getenv("{{.BenchmarkEnv}}")
+	if len(os.Args) > 1 {
+		name = os.Args[1]
+	}
+{{end}}
+	iterations := os.Getenv("{{.IterationsEnv}}")
+	if len(os.Args) > {{.IterationsArg}} {
+		iterations = os.Args[{{.IterationsArg}}]
+	}
+	if len(os.Args) > {{.IterationsArg}}+1 {
+		usage()
+	}
+	if iterations != "" {
+		n, err := strconv.Atoi(iterations)
+		if err != nil || n < 1 {
+			fmt.Fprintf(os.Stderr, "invalid number of iterations %q: expected a positive integer\n", iterations)
+			usage()
+		}
+		orig.{{.IterationsVar}} = n
+	}
+{{if .Input}}
+{{- if eq .Input "-"}}
+	orig.GoBBSetInput(os.Stdin)
+{{- else}}
+	input, err := os.Open({{printf "%q" .Input}})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	{{- if .InputVar}}
+	orig.GoBBSetInput(input)
+	{{- else}}
+	os.Stdin = input
+	{{- end}}
+{{- end}}
+{{end}}
+{{- if .SetFlags}}
+	if err := orig.GoBBSetFlags(); err != nil {
+		fmt.Fprintln(os.Stderr, "invalid -set-flag:", err)
+		os.Exit(2)
+	}
+{{end}}
+{{- if .ProfileDir}}
+	profileDir := {{printf "%q" .ProfileDir}}
+	{{- if .ProfilePerRun}}
+	run := os.Getenv("{{.RunIDEnv}}")
+	if run == "" {
+		run = time.Now().Format("20060102-150405.000000")
+	}
+	profileDir = filepath.Join(profileDir, run)
+	{{- end}}
+	if err := os.MkdirAll(profileDir, 0755); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+{{end}}
+{{- if or .CPUProfile .ProfileDir}}
+	cpuProfile := ""
+	{{- if .ProfileDir}}
+	cpuProfile = filepath.Join(profileDir, "cpu.pprof")
+	{{- end}}
+	{{- if .CPUProfile}}
+	if p := os.Getenv("{{.CPUProfileEnv}}"); p != "" {
+		cpuProfile = p
+	}
+	{{- end}}
+	if cpuProfile != "" {
+		f, err := os.Create(cpuProfile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer pprof.StopCPUProfile()
+		// Write the profile so far if the run is interrupted, for
+		// example by -benchmark-timeout.
+		interrupted := make(chan os.Signal, 1)
+		signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-interrupted
+			pprof.StopCPUProfile()
+			f.Close()
+			fmt.Fprintln(os.Stderr, "interrupted: CPU profile so far written to", cpuProfile)
+			os.Exit(1)
+		}()
+	}
+{{end}}
+{{- if .Report}}
+	stopSampling := make(chan struct{})
+	peakHeap := make(chan uint64)
+	go samplePeakHeap(stopSampling, peakHeap)
+	var before, after stats
+{{end}}
+	// In its own goroutine, which b.FailNow and b.SkipNow end.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+{{- if .Report}}
+		// Right around the benchmark, which may end the goroutine.
+		defer readStats(&after)
+		readStats(&before)
+{{- end}}
+{{- if .Multi}}
+		switch name {
+		{{- range .Funcs}}
+		case "{{.Key}}":
+			{{.Pkg}}.{{.Name}}()
+		{{- end}}
+		default:
+			usage()
+		}
+{{- else}}
+		{{with index .Funcs 0}}{{.Pkg}}.{{.Name}}(){{end}}
+{{- end}}
+	}()
+	<-done
+{{- if .Report}}
+	close(stopSampling)
+
+	printReport(before, after, <-peakHeap)
+{{- end}}
+{{- if .Latency}}
+
+	orig.GoBBPrintLatency(os.Stderr)
+{{- end}}
+{{- if .ProfileDir}}
+
+	writeHeapProfile(filepath.Join(profileDir, "mem.pprof"))
+	fmt.Fprintln(os.Stderr, "profiles written to", profileDir)
+{{- end}}
+
+	switch {
+	case orig.GoBBFailed():
+		fmt.Fprintln(os.Stderr, "FAIL")
+{{- if or .CPUProfile .ProfileDir}}
+		pprof.StopCPUProfile()
+{{- end}}
+		os.Exit(1)
+	case orig.GoBBSkipped():
+		fmt.Fprintln(os.Stderr, "SKIP")
+	}
+}
+{{- if .ProfileDir}}
+
+// writeHeapProfile writes the heap profile as of the end of the run, like
+// go test -memprofile.
+func writeHeapProfile(path string) {
+	runtime.GC()
+	f, err := os.Create(path)
+	if err == nil {
+		err = pprof.WriteHeapProfile(f)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+{{- end}}
+{{- if .Report}}
+
+type stats struct {
+	mem      runtime.MemStats
+	gcCycles uint64
+}
+
+// statsSample is read by readStats, allocated beforehand so that reading it
+// does not count as an allocation of the benchmark.
+var statsSample = []metrics.Sample{{"{{"}}Name: "/gc/cycles/total:gc-cycles"{{"}}"}}
+
+func readStats(s *stats) {
+	metrics.Read(statsSample)
+	if statsSample[0].Value.Kind() == metrics.KindUint64 {
+		s.gcCycles = statsSample[0].Value.Uint64()
+	}
+	runtime.ReadMemStats(&s.mem)
+}
+
+// samplePeakHeap samples the bytes of the heap objects every millisecond
+// until stop is closed, then sends the largest sample to peak.
+func samplePeakHeap(stop <-chan struct{}, peak chan<- uint64) {
+	sample := []metrics.Sample{{"{{"}}Name: "/memory/classes/heap/objects:bytes"{{"}}"}}
+	ticker := time.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+	var largest uint64
+	for {
+		metrics.Read(sample)
+		if sample[0].Value.Kind() == metrics.KindUint64 && sample[0].Value.Uint64() > largest {
+			largest = sample[0].Value.Uint64()
+		}
+		select {
+		case <-stop:
+			peak <- largest
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func printReport(before, after stats, peakHeap uint64) {
+	fmt.Fprintf(os.Stderr, "allocations: %d (%d bytes), GC cycles: %d, peak heap: %d bytes\n",
+		after.mem.Mallocs-before.mem.Mallocs,
+		after.mem.TotalAlloc-before.mem.TotalAlloc,
+		after.gcCycles-before.gcCycles,
+		peakHeap)
+}
+{{- end}}
+
+func usage() {
+{{- if .Multi}}
+	fmt.Fprintf(os.Stderr, "usage: %s BENCHMARK [ITERATIONS]\n\nBENCHMARK defaults to ${{.BenchmarkEnv}}, ITERATIONS to ${{.IterationsEnv}} or {{.Iterations}}.\n\navailable benchmarks:\n", os.Args[0])
+	{{- range .Funcs}}
+	fmt.Fprintln(os.Stderr, "  {{.Key}}")
+	{{- end}}
+{{- else}}
+	fmt.Fprintf(os.Stderr, "usage: %s [ITERATIONS]\n\nITERATIONS defaults to ${{.IterationsEnv}}, or {{.Iterations}}.\n", os.Args[0])
+{{- end}}
+	os.Exit(2)
+}
+`
+
+// stubType is the type of the copied package b is rebound to with
+// -inline-stubs.
+const stubType = "GoBBB"
+
+// stubConstructor is the function of the copied package returning the
+// stubType value of a benchmark, and stubDone the method of stubType the
+// benchmark defers.
+const (
+	stubConstructor = "GoBBNewB"
+	stubDone        = "GoBBDone"
+)
+
+// hooksFileName is the name of the generated file holding the hooks in the
+// copied package.
+const hooksFileName = "zz_gobb_hooks.go"
+
+type hooksContext struct {
+	Package       string
+	IterationsVar string
+	// Default value of IterationsVar.
+	Iterations int
+	// Default number of goroutines per GOMAXPROCS of GoBBRunParallel.
+	Parallelism int
+	// Name of the package-level io.Reader variable set by GoBBSetInput.
+	InputVar string
+	// True if GoBBTick and GoBBPrintLatency are generated.
+	Latency bool
+	// Flags and variables set by GoBBSetFlags.
+	SetFlags []setFlag
+	// Name of the type generated for -inline-stubs, if any.
+	StubType string
+	// True if the logs of the benchmarks are printed, by GoBBLog and
+	// GoBBLogf or by the methods of StubType.
+	KeepLogs bool
+	// True if the timer methods of the benchmarks label the CPU profile
+	// samples, through the GoBB*Timer hooks.
+	TimerLabels bool
+}
+
+const hooksTemplate = `
+// Code generated by go-bb. DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// {{.IterationsVar}} replaces b.N in the rewritten benchmarks.
+var {{.IterationsVar}} = {{.Iterations}}
+
+// Outcome of the benchmark, recorded by the hooks replacing the methods of b
+// reporting failures and skips, which may be called from any goroutine.
+var gobbFailed, gobbSkipped int32
+
+// GoBBFail replaces b.Fail.
+func GoBBFail() {
+	atomic.StoreInt32(&gobbFailed, 1)
+}
+
+// GoBBFailNow replaces b.FailNow: it ends the calling goroutine, like in go
+// test.
+func GoBBFailNow() {
+	GoBBFail()
+	runtime.Goexit()
+}
+
+// GoBBFailed replaces b.Failed.
+func GoBBFailed() bool {
+	return atomic.LoadInt32(&gobbFailed) != 0
+}
+
+// GoBBError replaces b.Error.
+func GoBBError(args ...interface{}) {
+	fmt.Fprintln(os.Stderr, args...)
+	GoBBFail()
+}
+
+// GoBBErrorf replaces b.Errorf.
+func GoBBErrorf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	GoBBFail()
+}
+
+// GoBBFatal replaces b.Fatal.
+func GoBBFatal(args ...interface{}) {
+	fmt.Fprintln(os.Stderr, args...)
+	GoBBFailNow()
+}
+
+// GoBBFatalf replaces b.Fatalf.
+func GoBBFatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	GoBBFailNow()
+}
+
+// GoBBSkipNow replaces b.SkipNow: it ends the calling goroutine.
+func GoBBSkipNow() {
+	atomic.StoreInt32(&gobbSkipped, 1)
+	runtime.Goexit()
+}
+
+// GoBBSkipped replaces b.Skipped.
+func GoBBSkipped() bool {
+	return atomic.LoadInt32(&gobbSkipped) != 0
+}
+
+// GoBBSkip replaces b.Skip.
+func GoBBSkip(args ...interface{}) {
+	fmt.Fprintln(os.Stderr, args...)
+	GoBBSkipNow()
+}
+
+// GoBBSkipf replaces b.Skipf.
+func GoBBSkipf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	GoBBSkipNow()
+}
+
+// GoBBElapsed replaces b.Elapsed when its result is used. Like the time
+// measured by go test once b.ResetTimer is called, it is not measured.
+func GoBBElapsed() time.Duration {
+	return 0
+}
+
+// GoBBTempDir replaces b.TempDir when its result is used. The directory is
+// not removed.
+func GoBBTempDir() string {
+	dir, err := os.MkdirTemp("", "gobb-*")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	return dir
+}
+
+// gobbParallelism is the number of goroutines per GOMAXPROCS of
+// GoBBRunParallel.
+var gobbParallelism = {{.Parallelism}}
+
+// GoBBSetParallelism replaces b.SetParallelism.
+func GoBBSetParallelism(p int) {
+	if p >= 1 {
+		gobbParallelism = p
+	}
+}
+
+// GoBBPB replaces testing.PB in the functions given to GoBBRunParallel.
+type GoBBPB struct {
+	// Number of iterations taken by all the goroutines, shared.
+	next *int64
+	// Number of iterations taken at once, and left of the last ones.
+	grain, cache int64
+}
+
+// Next reports whether there are more iterations to run.
+func (pb *GoBBPB) Next() bool {
+	if pb.cache == 0 {
+		left := int64({{.IterationsVar}}) - atomic.AddInt64(pb.next, pb.grain) + pb.grain
+		if left <= 0 {
+			return false
+		}
+		pb.cache = pb.grain
+		if left < pb.grain {
+			pb.cache = left
+		}
+	}
+	pb.cache--
+	return true
+}
+
+// GoBBRunParallel replaces b.RunParallel: it runs body in gobbParallelism
+// goroutines per GOMAXPROCS, which share the {{.IterationsVar}} iterations, and
+// returns once they all do.
+func GoBBRunParallel(body func(*GoBBPB)) {
+	procs := gobbParallelism * runtime.GOMAXPROCS(0)
+	grain := int64({{.IterationsVar}} / (100 * procs))
+	if grain < 1 {
+		grain = 1
+	} else if grain > 10000 {
+		grain = 10000
+	}
+	var next int64
+	var wg sync.WaitGroup
+	wg.Add(procs)
+	for i := 0; i < procs; i++ {
+		go func() {
+			defer wg.Done()
+			body(&GoBBPB{next: &next, grain: grain})
+		}()
+	}
+	wg.Wait()
+}
+
+{{- if .InputVar}}
+
+// GoBBSetInput sets the reader the benchmark reads its input from.
+func GoBBSetInput(r io.Reader) {
+	{{.InputVar}} = r
+}
+{{- end}}
+
+{{- if and .KeepLogs (not .StubType)}}
+
+// GoBBLog replaces b.Log in the benchmarks rewritten with -keep-logs.
+func GoBBLog(args ...interface{}) {
+	fmt.Fprintln(os.Stderr, args...)
+}
+
+// GoBBLogf replaces b.Logf in the benchmarks rewritten with -keep-logs.
+func GoBBLogf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+}
+{{- end}}
+
+{{- if .TimerLabels}}
+
+// Labels of the CPU profile samples, set by the hooks replacing the timer
+// methods of b with -timer-labels: gobb=timed while the timer of go test would
+// run, gobb=stopped after b.StopTimer, and gobb=setup before b.ResetTimer.
+var (
+	gobbTimerOn    = true
+	gobbTimedCtx   = pprof.WithLabels(context.Background(), pprof.Labels("gobb", "timed"))
+	gobbStoppedCtx = pprof.WithLabels(context.Background(), pprof.Labels("gobb", "stopped"))
+	gobbSetupCtx   = pprof.WithLabels(context.Background(), pprof.Labels("gobb", "setup"))
+)
+
+// GoBBSetupTimer starts the benchmarks calling b.ResetTimer.
+func GoBBSetupTimer() {
+	pprof.SetGoroutineLabels(gobbSetupCtx)
+}
+
+// GoBBResetTimer replaces b.ResetTimer: what comes before is setup.
+func GoBBResetTimer() {
+	if gobbTimerOn {
+		pprof.SetGoroutineLabels(gobbTimedCtx)
+	}
+}
+
+// GoBBStartTimer replaces b.StartTimer.
+func GoBBStartTimer() {
+	gobbTimerOn = true
+	pprof.SetGoroutineLabels(gobbTimedCtx)
+}
+
+// GoBBStopTimer replaces b.StopTimer.
+func GoBBStopTimer() {
+	gobbTimerOn = false
+	pprof.SetGoroutineLabels(gobbStoppedCtx)
+}
+{{- end}}
+
+{{- with .StubType}}
+
+// {{.}} replaces testing.B in the benchmarks rewritten with -inline-stubs.
+// Reporting methods do nothing, and the timer ones only measure Elapsed.
+// Failures and skips are printed and recorded by the hooks replacing them
+// without -inline-stubs.
+type {{.}} struct {
+	N int
+
+	name   string
+	loopN  int
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	cleanups []func()
+
+	// Time measured until the timer was last stopped, and when it was last
+	// started, if it runs.
+	elapsed time.Duration
+	start   time.Time
+}
+
+// GoBBNewB returns the {{.}} the rewritten benchmark named name, as go test
+// reports it, runs with, whose timer runs. The benchmark defers a call of its
+// GoBBDone method.
+func GoBBNewB(name string) *{{.}} {
+	b := &{{.}}{N: {{$.IterationsVar}}, name: name, start: time.Now()}
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+	return b
+}
+
+// GoBBDone cancels the context of b, then runs the functions registered with
+// Cleanup, last registered first, like go test once a benchmark returns.
+func (b *{{.}}) GoBBDone() {
+	b.cancel()
+	b.mu.Lock()
+	cleanups := b.cleanups
+	b.cleanups = nil
+	b.mu.Unlock()
+	for i := len(cleanups) - 1; i >= 0; i-- {
+		cleanups[i]()
+	}
+}
+
+func (b *{{.}}) ResetTimer() {
+	if !b.start.IsZero() {
+		b.start = time.Now()
+	}
+	b.elapsed = 0
+{{- if $.TimerLabels}}
+	GoBBResetTimer()
+{{- end}}
+}
+
+func (b *{{.}}) StartTimer() {
+	if b.start.IsZero() {
+		b.start = time.Now()
+	}
+{{- if $.TimerLabels}}
+	GoBBStartTimer()
+{{- end}}
+}
+
+func (b *{{.}}) StopTimer() {
+	if !b.start.IsZero() {
+		b.elapsed += time.Since(b.start)
+		b.start = time.Time{}
+	}
+{{- if $.TimerLabels}}
+	GoBBStopTimer()
+{{- end}}
+}
+
+func (b *{{.}}) Elapsed() time.Duration {
+	d := b.elapsed
+	if !b.start.IsZero() {
+		d += time.Since(b.start)
+	}
+	return d
+}
+
+func (b *{{.}}) ReportAllocs()                        {}
+func (b *{{.}}) SetBytes(n int64)                     {}
+func (b *{{.}}) SetParallelism(p int)                 { GoBBSetParallelism(p) }
+func (b *{{.}}) RunParallel(body func(*GoBBPB))       { GoBBRunParallel(body) }
+func (b *{{.}}) ReportMetric(n float64, unit string)  {}
+func (b *{{.}}) Helper()                              {}
+func (b *{{.}}) Attr(key, value string)               {}
+{{- if $.KeepLogs}}
+func (b *{{.}}) Log(args ...interface{})              { fmt.Fprintln(os.Stderr, args...) }
+func (b *{{.}}) Logf(format string, args ...interface{}) { fmt.Fprintf(os.Stderr, format+"\n", args...) }
+func (b *{{.}}) Output() io.Writer                    { return os.Stderr }
+{{- else}}
+func (b *{{.}}) Log(args ...interface{})              {}
+func (b *{{.}}) Logf(format string, args ...interface{}) {}
+func (b *{{.}}) Output() io.Writer                    { return io.Discard }
+{{- end}}
+func (b *{{.}}) Name() string                         { return b.name }
+func (b *{{.}}) Failed() bool                         { return GoBBFailed() }
+func (b *{{.}}) Skipped() bool                        { return GoBBSkipped() }
+func (b *{{.}}) Context() context.Context             { return b.ctx }
+
+func (b *{{.}}) Cleanup(f func()) {
+	b.mu.Lock()
+	b.cleanups = append(b.cleanups, f)
+	b.mu.Unlock()
+}
+
+func (b *{{.}}) Setenv(key, value string) {
+	prev, ok := os.LookupEnv(key)
+	if err := os.Setenv(key, value); err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		if ok {
+			os.Setenv(key, prev)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func (b *{{.}}) Chdir(dir string) {
+	prev, err := os.Getwd()
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { os.Chdir(prev) })
+}
+
+func (b *{{.}}) TempDir() string {
+	dir, err := os.MkdirTemp("", "gobb-*")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// ArtifactDir is a temporary directory, like without go test -artifacts.
+func (b *{{.}}) ArtifactDir() string {
+	return b.TempDir()
+}
+
+// Loop reports whether the benchmark should run one more iteration.
+func (b *{{.}}) Loop() bool {
+	b.loopN++
+	return b.loopN <= b.N
+}
+
+// Run runs f with a new {{.}}, in its own goroutine, which FailNow and SkipNow
+// end, and reports whether the benchmark has not failed so far.
+func (b *{{.}}) Run(name string, f func(b *{{.}})) bool {
+	sub := GoBBNewB(b.name + "/" + strings.ReplaceAll(name, " ", "_"))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer sub.GoBBDone()
+		f(sub)
+	}()
+	<-done
+	return !GoBBFailed()
+}
+
+func (b *{{.}}) Fail()                                     { GoBBFail() }
+func (b *{{.}}) FailNow()                                  { GoBBFailNow() }
+func (b *{{.}}) Error(args ...interface{})                 { GoBBError(args...) }
+func (b *{{.}}) Errorf(format string, args ...interface{}) { GoBBErrorf(format, args...) }
+func (b *{{.}}) Fatal(args ...interface{})                 { GoBBFatal(args...) }
+func (b *{{.}}) Fatalf(format string, args ...interface{}) { GoBBFatalf(format, args...) }
+func (b *{{.}}) SkipNow()                                  { GoBBSkipNow() }
+func (b *{{.}}) Skip(args ...interface{})                  { GoBBSkip(args...) }
+func (b *{{.}}) Skipf(format string, args ...interface{})  { GoBBSkipf(format, args...) }
+{{- end}}
+
+{{- if .SetFlags}}
+
+// GoBBSetFlags sets the flags and variables given to go-bb with -set-flag.
+func GoBBSetFlags() error {
+	{{- range .SetFlags}}
+	if err := gobbSetFlag({{printf "%q" .Name}}, {{if .Var}}&{{.Name}}{{else}}nil{{end}}, {{printf "%q" .Value}}); err != nil {
+		return err
+	}
+	{{- end}}
+	return nil
+}
+
+// gobbSetFlag sets the flag registered as name to value, or else the variable
+// v points to, if not nil.
+func gobbSetFlag(name string, v interface{}, value string) error {
+	if f := flag.Lookup(name); f != nil {
+		return f.Value.Set(value)
+	}
+	var err error
+	switch p := v.(type) {
+	case nil:
+		return fmt.Errorf("no flag or package-level variable named %s", name)
+	case flag.Value:
+		err = p.Set(value)
+	case *string:
+		*p = value
+	case *bool:
+		*p, err = strconv.ParseBool(value)
+	case *int:
+		*p, err = strconv.Atoi(value)
+	case *int64:
+		*p, err = strconv.ParseInt(value, 0, 64)
+	case *uint:
+		var u uint64
+		u, err = strconv.ParseUint(value, 0, strconv.IntSize)
+		*p = uint(u)
+	case *uint64:
+		*p, err = strconv.ParseUint(value, 0, 64)
+	case *float64:
+		*p, err = strconv.ParseFloat(value, 64)
+	case *time.Duration:
+		*p, err = time.ParseDuration(value)
+	default:
+		return fmt.Errorf("variable %s has unsupported type %T", name, v)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+{{- end}}
+
+{{- if .Latency}}
+
+// Latency histogram. Durations are recorded in log-linear buckets: each power
+// of two is split in 1<<gobbSubBits buckets, which bounds the relative error
+// of the percentiles to 1/(1<<gobbSubBits).
+const gobbSubBits = 3
+
+var (
+	gobbLast    time.Time
+	gobbBuckets [64 << gobbSubBits]uint64
+	gobbCount   uint64
+	gobbSum     time.Duration
+	gobbMin     time.Duration
+	gobbMax     time.Duration
+)
+
+// GoBBTick wraps the condition of the benchmark loop, and records the
+// duration of the previous iteration. The time between the end of a loop,
+// when cont is false, and the start of the next one is not recorded.
+func GoBBTick(cont bool) bool {
+	now := time.Now()
+	if !gobbLast.IsZero() {
+		gobbRecord(now.Sub(gobbLast))
+	}
+	gobbLast = now
+	if !cont {
+		gobbLast = time.Time{}
+	}
+	return cont
+}
+
+func gobbRecord(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	gobbBuckets[gobbBucket(uint64(d))]++
+	if gobbCount == 0 || d < gobbMin {
+		gobbMin = d
+	}
+	if d > gobbMax {
+		gobbMax = d
+	}
+	gobbCount++
+	gobbSum += d
+}
+
+func gobbBucket(v uint64) int {
+	if v < 1<<gobbSubBits {
+		return int(v)
+	}
+	exp := bits.Len64(v) - 1 - gobbSubBits
+	return (exp+1)<<gobbSubBits + int(v>>uint(exp)) - 1<<gobbSubBits
+}
+
+// gobbBucketMax returns the largest value of bucket i.
+func gobbBucketMax(i int) uint64 {
+	if i < 1<<gobbSubBits {
+		return uint64(i)
+	}
+	exp := i>>gobbSubBits - 1
+	mantissa := uint64(i&(1<<gobbSubBits-1)) + 1<<gobbSubBits
+	return (mantissa+1)<<uint(exp) - 1
+}
+
+func gobbPercentile(p float64) time.Duration {
+	rank := uint64(p * float64(gobbCount))
+	if rank >= gobbCount {
+		rank = gobbCount - 1
+	}
+	var seen uint64
+	for i, c := range gobbBuckets {
+		seen += c
+		if seen > rank {
+			d := time.Duration(gobbBucketMax(i))
+			if d > gobbMax {
+				d = gobbMax
+			}
+			return d
+		}
+	}
+	return gobbMax
+}
+
+// GoBBPrintLatency writes percentiles of the durations of the iterations to
+// w.
+func GoBBPrintLatency(w io.Writer) {
+	if gobbCount == 0 {
+		fmt.Fprintln(w, "latency: no iteration recorded")
+		return
+	}
+	fmt.Fprintf(w, "latency over %d iterations: min %v, mean %v, p50 %v, p90 %v, p99 %v, max %v\n",
+		gobbCount, gobbMin, gobbSum/time.Duration(gobbCount),
+		gobbPercentile(0.50), gobbPercentile(0.90), gobbPercentile(0.99), gobbMax)
+}
+{{- end}}
+`
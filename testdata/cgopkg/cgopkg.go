@@ -0,0 +1,3 @@
+// Package cgopkg has an implementation with cgo and one without, of which
+// the benchmark checks that the one of the cgo setting is built.
+package cgopkg
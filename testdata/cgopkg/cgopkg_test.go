@@ -0,0 +1,15 @@
+package cgopkg
+
+import (
+	"os"
+	"testing"
+)
+
+func BenchmarkImpl(b *testing.B) {
+	want := os.Getenv("CGOPKG_IMPL")
+	for i := 0; i < b.N; i++ {
+		if got := impl(); got != want {
+			b.Fatalf("built the %s implementation, want %s", got, want)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build cgo
+// +build cgo
+
+package cgopkg
+
+func impl() string {
+	return "cgo"
+}
@@ -0,0 +1,7 @@
+// Package emitpkg is benchmarked with -emit-func, its benchmark using
+// declarations of both the package and its test file.
+package emitpkg
+
+func work(x int) int {
+	return x * x
+}
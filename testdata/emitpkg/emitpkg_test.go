@@ -0,0 +1,32 @@
+package emitpkg
+
+import (
+	"strconv"
+	"testing"
+)
+
+const factor = 3
+
+type scaler struct {
+	by int
+}
+
+func (s scaler) scale(x int) int {
+	return s.by * work(x)
+}
+
+var label = strconv.Itoa(factor)
+
+func BenchmarkScaled(b *testing.B) {
+	s := scaler{by: factor}
+	for i := 0; i < b.N*factor; i++ {
+		s.scale(i)
+	}
+	b.ReportMetric(float64(len(label)), "label")
+}
+
+func TestWork(t *testing.T) {
+	if work(2) != 4 {
+		t.Fail()
+	}
+}
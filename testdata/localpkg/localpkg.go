@@ -0,0 +1,9 @@
+// Package localpkg imports another package of its module, which the
+// temporary module only finds with -local-module.
+package localpkg
+
+import "github.com/pelletier/go-bb/testdata/tdpkg"
+
+func triple(x int) int {
+	return tdpkg.Double(x) + x
+}
@@ -0,0 +1,9 @@
+package localpkg
+
+import "testing"
+
+func BenchmarkTriple(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		triple(i)
+	}
+}
@@ -0,0 +1,15 @@
+package main
+
+import "fmt"
+
+func sum(data []int) int {
+	total := 0
+	for _, x := range data {
+		total += x
+	}
+	return total
+}
+
+func main() {
+	fmt.Println(sum([]int{1, 2, 3}))
+}
@@ -0,0 +1,10 @@
+package main
+
+import "testing"
+
+func BenchmarkSum(b *testing.B) {
+	data := []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 0}
+	for i := 0; i < b.N; i++ {
+		sum(data)
+	}
+}
@@ -0,0 +1,7 @@
+// Package tdpkg has a testdata directory holding a Go file that does not
+// compile.
+package tdpkg
+
+func Double(x int) int {
+	return 2 * x
+}
@@ -0,0 +1,9 @@
+package tdpkg
+
+import "testing"
+
+func BenchmarkDouble(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		Double(i)
+	}
+}
@@ -0,0 +1,4 @@
+package broken
+
+// Does not compile.
+var x int = "x"
@@ -0,0 +1,3 @@
+package xtestpkg
+
+var Double = double
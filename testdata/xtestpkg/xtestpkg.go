@@ -0,0 +1,7 @@
+// Package xtestpkg is benchmarked from its external test package, through
+// the bridge of export_test.go.
+package xtestpkg
+
+func double(x int) int {
+	return 2 * x
+}
@@ -0,0 +1,13 @@
+package xtestpkg_test
+
+import (
+	"testing"
+
+	"github.com/pelletier/go-bb/testdata/xtestpkg"
+)
+
+func BenchmarkDouble(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		xtestpkg.Double(i)
+	}
+}
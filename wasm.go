@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"go/build"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+)
+
+// isWasm returns true if the binary is built for WebAssembly.
+func isWasm() bool {
+	return build.Default.GOARCH == "wasm"
+}
+
+// wasmUnsupportedImports are standard packages that do not work, or only
+// partially, once compiled to WebAssembly, with the reason why.
+var wasmUnsupportedImports = map[string]string{
+	"os/exec":   "processes cannot be started",
+	"os/signal": "signals are not delivered",
+	"os/user":   "there is no user database",
+	"plugin":    "plugins cannot be loaded",
+	"syscall":   "most system calls are not implemented",
+	"net":       "sockets are not available (js/wasm) or limited to preopened ones (wasip1)",
+	"net/http":  "only the client is available, through the browser fetch API (js/wasm)",
+}
+
+// warnWasmImports prints a warning for each import of the benchmarked package
+// that is not supported on WebAssembly. It only looks at direct imports.
+func warnWasmImports(pkg *build.Package) {
+	seen := map[string]bool{}
+	for _, imports := range [][]string{pkg.Imports, pkg.TestImports, pkg.XTestImports} {
+		for _, p := range imports {
+			if _, ok := wasmUnsupportedImports[p]; ok {
+				seen[p] = true
+			}
+		}
+	}
+	found := make([]string, 0, len(seen))
+	for p := range seen {
+		found = append(found, p)
+	}
+	sort.Strings(found)
+	for _, p := range found {
+		fmt.Fprintf(logOut, "Warning: %s imports %s, which is not supported on %s/%s: %s\n", pkg.Name, p, build.Default.GOOS, build.Default.GOARCH, wasmUnsupportedImports[p])
+	}
+}
+
+// wasmExecPath returns the path of the JavaScript glue needed to run a js/wasm
+// binary, or an empty string if it cannot be found.
+func wasmExecPath() string {
+	out, err := exec.Command("go", "env", "GOROOT").Output()
+	if err != nil {
+		return ""
+	}
+	goroot := strings.TrimSpace(string(out))
+	// Moved from misc/wasm in Go 1.24.
+	for _, dir := range []string{"lib/wasm", "misc/wasm"} {
+		p := path.Join(goroot, dir, "wasm_exec.js")
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	return ""
+}